@@ -0,0 +1,235 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+// DefaultChunkSize is the chunk size of the repositories that do not set
+// one.
+const DefaultChunkSize = 4 * 1024 * 1024
+
+// snapPrefix is the prefix of the snapshots taken for the backups.
+const snapPrefix = "backup-"
+
+const timeFormat = "20060102T150405.000000000Z"
+
+func (repo *Repository) chunkSize() uint64 {
+	if repo.ChunkSize == 0 {
+		return DefaultChunkSize
+	}
+	return repo.ChunkSize
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// dirtyChunks returns the offsets of the chunks of an image of size bytes
+// overlapping extents.
+func dirtyChunks(extents []rbd.Extent, size uint64, chunkSize uint64) map[uint64]bool {
+	dirty := make(map[uint64]bool)
+	for _, e := range extents {
+		end := e.Offset + e.Length
+		if end > size {
+			end = size
+		}
+		for off := e.Offset / chunkSize * chunkSize; off < end; off += chunkSize {
+			dirty[off] = true
+		}
+	}
+	return dirty
+}
+
+// hasSnap tells whether img has the snapshot name.
+func hasSnap(img *rbd.Image, name string) (bool, error) {
+	snaps, err := img.ListSnaps()
+	if err != nil {
+		return false, err
+	}
+	for _, s := range snaps {
+		if s.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Backup snapshots image and stores the content of the snapshot in the
+// repository.  When the snapshot of the previous backup of the image
+// still exists, only the extents changed since that snapshot are read,
+// and the snapshot is removed once the new backup is saved.  The snapshot
+// of the new backup is kept for the next one.
+func (repo *Repository) Backup(ctx context.Context, r *rbd.Rbd, image string) (*Manifest, error) {
+	chunkSize := repo.chunkSize()
+	parent, err := repo.latest(image)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := rbd.NewImage(r, image)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if parent != nil {
+		found, err := hasSnap(img, parent.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		if !found || parent.ChunkSize != chunkSize {
+			parent = nil
+		}
+	}
+
+	now := time.Now().UTC()
+	m := &Manifest{
+		Image:     image,
+		Snapshot:  snapPrefix + now.Format(timeFormat),
+		Time:      now,
+		ChunkSize: chunkSize,
+	}
+	if err := img.CreateSnap(m.Snapshot); err != nil {
+		return nil, err
+	}
+	saved := false
+	defer func() {
+		if !saved {
+			img.RemoveSnap(m.Snapshot)
+		}
+	}()
+
+	if err := repo.store(ctx, r, m, parent); err != nil {
+		return nil, err
+	}
+	if err := repo.saveManifest(m); err != nil {
+		return nil, err
+	}
+	saved = true
+	if parent != nil {
+		// A leftover snapshot only wastes space, the backup is saved.
+		img.RemoveSnap(parent.Snapshot)
+	}
+	return m, nil
+}
+
+// store reads the snapshot of m and stores its chunks, reusing the chunks
+// of parent that did not change.
+func (repo *Repository) store(ctx context.Context, r *rbd.Rbd, m *Manifest, parent *Manifest) error {
+	snap, err := rbd.NewImage(r, m.Image, rbd.ReadOnly, rbd.SnapshotName(m.Snapshot))
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	if m.Size, err = snap.Size(); err != nil {
+		return err
+	}
+
+	fromSnapshot := ""
+	if parent != nil {
+		fromSnapshot = parent.Snapshot
+		m.Parent = parent.Snapshot
+	}
+	extents, err := snap.ChangedExtents(ctx, fromSnapshot, 0, m.Size, true, false)
+	if err != nil {
+		return err
+	}
+	dirty := dirtyChunks(extents, m.Size, m.ChunkSize)
+	if parent != nil {
+		if parent.Size != m.Size {
+			// The length of the last chunk changed.
+			last := parent.Size
+			if m.Size < last {
+				last = m.Size
+			}
+			dirty[last/m.ChunkSize*m.ChunkSize] = true
+		}
+		for _, c := range parent.Chunks {
+			if c.Offset < m.Size && !dirty[c.Offset] {
+				m.Chunks = append(m.Chunks, c)
+			}
+		}
+	}
+
+	offsets := make([]uint64, 0, len(dirty))
+	for off := range dirty {
+		if off < m.Size {
+			offsets = append(offsets, off)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	var src io.ReaderAt = snap
+	if repo.Reader != nil {
+		src = repo.Reader(snap)
+	}
+	buf := make([]byte, m.ChunkSize)
+	for _, off := range offsets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		length := m.ChunkSize
+		if m.Size-off < length {
+			length = m.Size - off
+		}
+		data := buf[:length]
+		n, err := src.ReadAt(data, int64(off))
+		if err != nil && !(err == io.EOF && n == len(data)) {
+			return err
+		}
+		if isZero(data) {
+			continue
+		}
+		hash, err := repo.putChunk(data)
+		if err != nil {
+			return err
+		}
+		m.Chunks = append(m.Chunks, Chunk{off, length, hash})
+	}
+	sort.Slice(m.Chunks, func(i, j int) bool { return m.Chunks[i].Offset < m.Chunks[j].Offset })
+	return nil
+}
+
+// Restore creates the image name in r, with the content of the backup m.
+// The options are passed to Rbd.Create.  The image is removed if the
+// restoration fails.
+func (repo *Repository) Restore(ctx context.Context, m *Manifest, r *rbd.Rbd, name string, options ...func(*rbd.Config) error) (err error) {
+	if err := r.Create(name, m.Size, options...); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			r.Remove(name)
+		}
+	}()
+	img, err := rbd.NewImage(r, name)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	for _, c := range m.Chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := repo.getChunk(c.Hash)
+		if err != nil {
+			return err
+		}
+		if uint64(len(data)) != c.Length {
+			return fmt.Errorf("Chunk %s is %d bytes long, expected %d", c.Hash, len(data), c.Length)
+		}
+		if _, err := img.WriteAt(data, int64(c.Offset)); err != nil {
+			return err
+		}
+	}
+	return img.Flush()
+}
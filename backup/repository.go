@@ -0,0 +1,212 @@
+// Package backup stores incremental backups of rbd images in a local
+// directory.
+//
+// A repository is laid out as:
+//
+//	chunks/ab/abcdef...     the gzip compressed chunks, named after the
+//	                        SHA-256 of their uncompressed content
+//	manifests/image/snap    the json manifest of the backup of image
+//	                        taken from its snapshot snap
+//
+// Chunks are shared by all the backups of the repository, so that data
+// stored once is never stored again.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+// Chunk is a chunk of the image content.  Chunks absent from a manifest
+// are zero.
+type Chunk struct {
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+	Hash   string `json:"hash"`
+}
+
+// Manifest describes a backup.
+type Manifest struct {
+	Image string `json:"image"`
+	// Snapshot is the name of the snapshot of the image the backup was
+	// taken from.  It identifies the backup in the repository.
+	Snapshot string `json:"snapshot"`
+	// Parent is the snapshot of the previous backup when the backup is
+	// incremental.
+	Parent    string    `json:"parent,omitempty"`
+	Time      time.Time `json:"time"`
+	Size      uint64    `json:"size"`
+	ChunkSize uint64    `json:"chunk_size"`
+	// Chunks lists the non-zero chunks, sorted by offset.
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Repository is a directory holding backups.
+type Repository struct {
+	// ChunkSize is the size of the chunks of the new backups,
+	// DefaultChunkSize when zero.  Backups are incremental only when
+	// the chunk size does not change.
+	ChunkSize uint64
+	// Reader, when set, wraps the snapshots read by the backups, like
+	// rbd.Throttle does to limit their I/O.
+	Reader func(*rbd.Image) io.ReaderAt
+
+	dir string
+}
+
+// Open opens the repository in dir, creating it if needed.
+func Open(dir string) (*Repository, error) {
+	for _, sub := range []string{"chunks", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Repository{dir: dir}, nil
+}
+
+func hashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (repo *Repository) chunkPath(hash string) string {
+	return filepath.Join(repo.dir, "chunks", hash[:2], hash)
+}
+
+// writeFile atomically writes data to name.
+func writeFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// putChunk stores data unless a chunk with the same content is already
+// stored, and returns its hash.
+func (repo *Repository) putChunk(data []byte) (string, error) {
+	hash := hashChunk(data)
+	name := repo.chunkPath(hash)
+	if _, err := os.Stat(name); err == nil {
+		return hash, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return hash, writeFile(name, buf.Bytes())
+}
+
+// getChunk reads the chunk hash and checks its content.
+func (repo *Repository) getChunk(hash string) ([]byte, error) {
+	f, err := os.Open(repo.chunkPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read chunk %s: %v", hash, err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read chunk %s: %v", hash, err)
+	}
+	if hashChunk(data) != hash {
+		return nil, fmt.Errorf("Chunk %s is corrupted", hash)
+	}
+	return data, nil
+}
+
+func (repo *Repository) manifestPath(image string, snapshot string) string {
+	return filepath.Join(repo.dir, "manifests", image, snapshot)
+}
+
+func (repo *Repository) saveManifest(m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(repo.manifestPath(m.Image, m.Snapshot), data)
+}
+
+// Manifest returns the manifest of the backup of image taken from
+// snapshot.
+func (repo *Repository) Manifest(image string, snapshot string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(repo.manifestPath(image, snapshot))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Cannot read manifest %s@%s: %v", image, snapshot, err)
+	}
+	return m, nil
+}
+
+// List returns the manifests of the backups of image, from the oldest to
+// the most recent.
+func (repo *Repository) List(image string) ([]*Manifest, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(repo.dir, "manifests", image))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []*Manifest
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name()[0] == '.' {
+			continue
+		}
+		m, err := repo.Manifest(image, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res, nil
+}
+
+// latest returns the most recent backup of image, nil if there is none.
+func (repo *Repository) latest(image string) (*Manifest, error) {
+	manifests, err := repo.List(image)
+	if err != nil || len(manifests) == 0 {
+		return nil, err
+	}
+	return manifests[len(manifests)-1], nil
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+func tempRepository(t *testing.T) *Repository {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	repo, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Cannot open repository %s: %v", dir, err)
+	}
+	return repo
+}
+
+func Test_Chunks(t *testing.T) {
+	repo := tempRepository(t)
+	data := bytes.Repeat([]byte("chunk"), 1000)
+	hash, err := repo.putChunk(data)
+	if err != nil {
+		t.Fatalf("Cannot store chunk: %v", err)
+	}
+	if again, err := repo.putChunk(data); err != nil || again != hash {
+		t.Errorf("Wrong hash for the same chunk, expected %s, got %s (%v)", hash, again, err)
+	}
+	files, _ := filepath.Glob(filepath.Join(repo.dir, "chunks", "*", "*"))
+	if len(files) != 1 {
+		t.Errorf("Chunk stored %d times", len(files))
+	}
+	if info, err := os.Stat(repo.chunkPath(hash)); err != nil || info.Size() >= int64(len(data)) {
+		t.Errorf("Chunk %s not compressed: %v", hash, err)
+	}
+	read, err := repo.getChunk(hash)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Wrong chunk read for %s: %v", hash, err)
+	}
+}
+
+func Test_CorruptedChunk(t *testing.T) {
+	repo := tempRepository(t)
+	hash, err := repo.putChunk([]byte("original"))
+	if err != nil {
+		t.Fatalf("Cannot store chunk: %v", err)
+	}
+	other, err := repo.putChunk([]byte("other"))
+	if err != nil {
+		t.Fatalf("Cannot store chunk: %v", err)
+	}
+	if err := os.Rename(repo.chunkPath(other), repo.chunkPath(hash)); err != nil {
+		t.Fatalf("Cannot replace chunk: %v", err)
+	}
+	if _, err := repo.getChunk(hash); err == nil {
+		t.Errorf("Corrupted chunk %s not detected", hash)
+	}
+}
+
+func Test_Manifests(t *testing.T) {
+	repo := tempRepository(t)
+	now := time.Now().UTC()
+	for i, snap := range []string{"b", "a", "c"} {
+		m := &Manifest{
+			Image:     "image",
+			Snapshot:  snap,
+			Time:      now.Add(time.Duration(i) * time.Minute),
+			Size:      10,
+			ChunkSize: 4,
+			Chunks:    []Chunk{{0, 4, "hash"}},
+		}
+		if err := repo.saveManifest(m); err != nil {
+			t.Fatalf("Cannot save manifest %s: %v", snap, err)
+		}
+	}
+	manifests, err := repo.List("image")
+	if err != nil {
+		t.Fatalf("Cannot list manifests: %v", err)
+	}
+	if len(manifests) != 3 || manifests[0].Snapshot != "b" || manifests[2].Snapshot != "c" {
+		t.Errorf("Wrong manifests listed: %v", manifests)
+	}
+	latest, err := repo.latest("image")
+	if err != nil || latest.Snapshot != "c" || len(latest.Chunks) != 1 {
+		t.Errorf("Wrong latest manifest %v: %v", latest, err)
+	}
+	if manifests, err := repo.List("missing"); err != nil || len(manifests) != 0 {
+		t.Errorf("Wrong manifests for a missing image: %v, %v", manifests, err)
+	}
+}
+
+func Test_DirtyChunks(t *testing.T) {
+	extents := []rbd.Extent{
+		{Offset: 1, Length: 2, Exists: true},
+		{Offset: 7, Length: 3, Exists: false},
+		{Offset: 18, Length: 10, Exists: true},
+	}
+	dirty := dirtyChunks(extents, 20, 4)
+	for _, off := range []uint64{0, 4, 8, 16} {
+		if !dirty[off] {
+			t.Errorf("Chunk %d not dirty", off)
+		}
+	}
+	if len(dirty) != 4 {
+		t.Errorf("Wrong dirty chunks: %v", dirty)
+	}
+}
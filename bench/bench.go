@@ -0,0 +1,268 @@
+// Package bench measures the performance of an image, like rbd bench.
+//
+// Run issues I/Os of a fixed size at sequential or random offsets from
+// Depth concurrent goroutines, mixing reads and writes, until a duration
+// or a total amount of bytes is reached.  It reports the IOPS, throughput
+// and latency percentiles of the reads, the writes and all the I/Os.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pattern is the pattern of the offsets of the I/Os.
+type Pattern string
+
+// I/O patterns.
+const (
+	Sequential Pattern = "seq"
+	Random     Pattern = "rand"
+)
+
+// Defaults of the configuration.
+const (
+	DefaultIOSize     = 4096
+	DefaultDepth      = 16
+	DefaultTotalBytes = 1024 * 1024 * 1024
+)
+
+// Target is the device benchmarked.  *rbd.Image implements it.
+type Target interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (uint64, error)
+}
+
+// Config is the configuration of a benchmark.
+type Config struct {
+	Pattern Pattern `json:"pattern"`
+	// IOSize is the size of each I/O, DefaultIOSize when zero.
+	IOSize int `json:"io_size"`
+	// Depth is the number of I/Os in flight, DefaultDepth when zero.
+	Depth int `json:"depth"`
+	// ReadPercent is the percentage of reads, the other I/Os are
+	// writes.
+	ReadPercent int `json:"read_percent"`
+	// Duration and TotalBytes stop the benchmark when reached, if not
+	// zero.  TotalBytes is DefaultTotalBytes when both are zero.
+	Duration   time.Duration `json:"duration_ns"`
+	TotalBytes uint64        `json:"total_bytes"`
+	// Seed of the random offsets and read/write mix.
+	Seed int64 `json:"seed"`
+}
+
+// Latency is the distribution of the latencies of I/Os.
+type Latency struct {
+	Min  time.Duration `json:"min_ns"`
+	Mean time.Duration `json:"mean_ns"`
+	P50  time.Duration `json:"p50_ns"`
+	P90  time.Duration `json:"p90_ns"`
+	P99  time.Duration `json:"p99_ns"`
+	P999 time.Duration `json:"p999_ns"`
+	Max  time.Duration `json:"max_ns"`
+}
+
+// Stats are the statistics of a kind of I/O.
+type Stats struct {
+	Ops   uint64  `json:"ops"`
+	Bytes uint64  `json:"bytes"`
+	IOPS  float64 `json:"iops"`
+	// Throughput is in bytes per second.
+	Throughput float64 `json:"throughput"`
+	Latency    Latency `json:"latency"`
+}
+
+// Result is the result of a benchmark.
+type Result struct {
+	Config  Config        `json:"config"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Read    Stats         `json:"read"`
+	Write   Stats         `json:"write"`
+	Total   Stats         `json:"total"`
+}
+
+func (c Config) withDefaults() (Config, error) {
+	if c.Pattern == "" {
+		c.Pattern = Sequential
+	}
+	if c.Pattern != Sequential && c.Pattern != Random {
+		return c, fmt.Errorf("Invalid I/O pattern %q", c.Pattern)
+	}
+	if c.IOSize == 0 {
+		c.IOSize = DefaultIOSize
+	}
+	if c.Depth == 0 {
+		c.Depth = DefaultDepth
+	}
+	if c.IOSize < 0 || c.Depth < 0 {
+		return c, errors.New("Invalid I/O size or depth")
+	}
+	if c.ReadPercent < 0 || c.ReadPercent > 100 {
+		return c, fmt.Errorf("Invalid read percentage %d", c.ReadPercent)
+	}
+	if c.Duration == 0 && c.TotalBytes == 0 {
+		c.TotalBytes = DefaultTotalBytes
+	}
+	return c, nil
+}
+
+// worker is the state of a goroutine issuing I/Os.
+type worker struct {
+	rng    *rand.Rand
+	buf    []byte
+	reads  []time.Duration
+	writes []time.Duration
+}
+
+// Run benchmarks t with cfg.  It stops early, without error, when ctx is
+// done.
+func Run(ctx context.Context, t Target, cfg Config) (*Result, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	size, err := t.Size()
+	if err != nil {
+		return nil, err
+	}
+	blocks := int64(size) / int64(cfg.IOSize)
+	if blocks == 0 {
+		return nil, fmt.Errorf("Target of %d bytes smaller than the I/O size %d", size, cfg.IOSize)
+	}
+	var maxOps int64 = -1
+	if cfg.TotalBytes != 0 {
+		maxOps = int64((cfg.TotalBytes + uint64(cfg.IOSize) - 1) / uint64(cfg.IOSize))
+	}
+	if cfg.Duration != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		issued   int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	workers := make([]*worker, cfg.Depth)
+	start := time.Now()
+	for i := range workers {
+		w := &worker{
+			rng: rand.New(rand.NewSource(cfg.Seed + int64(i))),
+			buf: make([]byte, cfg.IOSize),
+		}
+		w.rng.Read(w.buf)
+		workers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := atomic.AddInt64(&issued, 1) - 1
+				if maxOps >= 0 && n >= maxOps {
+					return
+				}
+				block := n % blocks
+				if cfg.Pattern == Random {
+					block = w.rng.Int63n(blocks)
+				}
+				if err := w.io(t, block*int64(cfg.IOSize), w.rng.Intn(100) < cfg.ReadPercent); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var reads, writes []time.Duration
+	for _, w := range workers {
+		reads = append(reads, w.reads...)
+		writes = append(writes, w.writes...)
+	}
+	all := append(append([]time.Duration{}, reads...), writes...)
+	return &Result{
+		Config:  cfg,
+		Elapsed: elapsed,
+		Read:    stats(reads, cfg.IOSize, elapsed),
+		Write:   stats(writes, cfg.IOSize, elapsed),
+		Total:   stats(all, cfg.IOSize, elapsed),
+	}, nil
+}
+
+// io issues a read or a write at offset and records its latency.
+func (w *worker) io(t Target, offset int64, read bool) error {
+	start := time.Now()
+	if read {
+		if n, err := t.ReadAt(w.buf, offset); err != nil && !(err == io.EOF && n == len(w.buf)) {
+			return err
+		}
+		w.reads = append(w.reads, time.Since(start))
+		return nil
+	}
+	if _, err := t.WriteAt(w.buf, offset); err != nil {
+		return err
+	}
+	w.writes = append(w.writes, time.Since(start))
+	return nil
+}
+
+// stats computes the statistics of I/Os of ioSize bytes with latencies,
+// made in elapsed.
+func stats(latencies []time.Duration, ioSize int, elapsed time.Duration) Stats {
+	s := Stats{Ops: uint64(len(latencies)), Bytes: uint64(len(latencies)) * uint64(ioSize)}
+	if len(latencies) == 0 {
+		return s
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		s.IOPS = float64(s.Ops) / seconds
+		s.Throughput = float64(s.Bytes) / seconds
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+	s.Latency = Latency{
+		Min:  latencies[0],
+		Mean: sum / time.Duration(len(latencies)),
+		P50:  percentile(latencies, 50),
+		P90:  percentile(latencies, 90),
+		P99:  percentile(latencies, 99),
+		P999: percentile(latencies, 99.9),
+		Max:  latencies[len(latencies)-1],
+	}
+	return s
+}
+
+// percentile returns the p-th percentile of the sorted latencies, using
+// the nearest rank method.  The rank is rounded down when within 1e-9 of
+// an integer, to ignore floating point errors.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
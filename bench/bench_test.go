@@ -0,0 +1,106 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memTarget is a Target in memory counting the I/Os.
+type memTarget struct {
+	mu      sync.Mutex
+	data    []byte
+	reads   int
+	writes  int
+	offsets map[int64]int
+	fail    error
+}
+
+func newMemTarget(size int) *memTarget {
+	return &memTarget{data: make([]byte, size), offsets: make(map[int64]int)}
+}
+
+func (m *memTarget) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+	m.offsets[off]++
+	return copy(p, m.data[off:]), m.fail
+}
+
+func (m *memTarget) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes++
+	m.offsets[off]++
+	return copy(m.data[off:], p), m.fail
+}
+
+func (m *memTarget) Size() (uint64, error) {
+	return uint64(len(m.data)), nil
+}
+
+func Test_RunTotalBytes(t *testing.T) {
+	m := newMemTarget(64 * 1024)
+	res, err := Run(context.Background(), m, Config{IOSize: 4096, Depth: 4, ReadPercent: 50, TotalBytes: 1024 * 1024})
+	if err != nil {
+		t.Fatalf("Cannot run benchmark: %v", err)
+	}
+	if res.Total.Ops != 256 || res.Total.Bytes != 1024*1024 {
+		t.Errorf("Wrong total, expected 256 ops, got %d ops of %d bytes", res.Total.Ops, res.Total.Bytes)
+	}
+	if res.Read.Ops != uint64(m.reads) || res.Write.Ops != uint64(m.writes) {
+		t.Errorf("Wrong read/write counts, expected %d/%d, got %d/%d", m.reads, m.writes, res.Read.Ops, res.Write.Ops)
+	}
+	if res.Read.Ops == 0 || res.Write.Ops == 0 {
+		t.Errorf("No read/write mix: %d reads, %d writes", res.Read.Ops, res.Write.Ops)
+	}
+	// Sequential I/Os go over the 16 blocks of the target evenly.
+	for off, count := range m.offsets {
+		if off%4096 != 0 || count != 16 {
+			t.Errorf("Wrong I/Os at offset %d: %d", off, count)
+		}
+	}
+	if res.Total.IOPS <= 0 || res.Total.Latency.Max < res.Total.Latency.Min {
+		t.Errorf("Wrong statistics: %+v", res.Total)
+	}
+}
+
+func Test_RunDuration(t *testing.T) {
+	m := newMemTarget(64 * 1024)
+	res, err := Run(context.Background(), m, Config{Pattern: Random, IOSize: 512, Depth: 2, ReadPercent: 100, Duration: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Cannot run benchmark: %v", err)
+	}
+	if res.Elapsed < 50*time.Millisecond || res.Write.Ops != 0 || res.Read.Ops == 0 {
+		t.Errorf("Wrong result: %+v", res)
+	}
+}
+
+func Test_RunError(t *testing.T) {
+	m := newMemTarget(4096)
+	m.fail = errors.New("failed")
+	if _, err := Run(context.Background(), m, Config{TotalBytes: 1024 * 1024}); err != m.fail {
+		t.Errorf("Wrong error, expected %v, got %v", m.fail, err)
+	}
+	if _, err := Run(context.Background(), m, Config{IOSize: 8192}); err == nil {
+		t.Errorf("I/O size larger than the target accepted")
+	}
+}
+
+func Test_Percentile(t *testing.T) {
+	latencies := make([]time.Duration, 1000)
+	for i := range latencies {
+		latencies[i] = time.Duration(i + 1)
+	}
+	for _, test := range []struct {
+		p        float64
+		expected time.Duration
+	}{{50, 500}, {90, 900}, {99, 990}, {99.9, 999}, {100, 1000}, {0, 1}} {
+		if got := percentile(latencies, test.p); got != test.expected {
+			t.Errorf("Wrong %vth percentile, expected %d, got %d", test.p, test.expected, got)
+		}
+	}
+}
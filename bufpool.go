@@ -0,0 +1,47 @@
+package rbd
+
+import "sync"
+
+// BufferPool is a pool of buffers of the same size, so that the helpers
+// copying data do not allocate a buffer for each call.  It is safe for
+// concurrent use.
+//
+// Buffers are handed out as *[]byte, so that returning them to the pool
+// does not allocate.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a pool of buffers of size bytes.
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Size returns the size of the buffers of the pool.
+func (p *BufferPool) Size() int {
+	return p.size
+}
+
+// Get returns a buffer of Size bytes.  Its content is undefined.
+func (p *BufferPool) Get() *[]byte {
+	buf := p.pool.Get().(*[]byte)
+	*buf = (*buf)[:p.size]
+	return buf
+}
+
+// Put returns buf to the pool.  buf must not be used afterwards.
+func (p *BufferPool) Put(buf *[]byte) {
+	if cap(*buf) < p.size {
+		return
+	}
+	p.pool.Put(buf)
+}
+
+// chunkPool holds the buffers of the sparse copy helpers.
+var chunkPool = NewBufferPool(copyChunkSize)
@@ -0,0 +1,216 @@
+package rbd
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrNotSnapshot is returned when caching an image that is not opened at
+// a snapshot, as only the data of snapshots never changes.
+var ErrNotSnapshot = errors.New("rbd: image not opened at a snapshot")
+
+// BlockCache is an in-process LRU cache of blocks of image snapshots.  A
+// cache is meant to be shared by the images it wraps, so that the
+// short-lived handles of the same snapshot reuse the blocks read by the
+// previous ones.  It is safe for concurrent use.
+type BlockCache struct {
+	blockSize int
+	maxBlocks int
+	readAhead int
+
+	mu     sync.Mutex
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+	stats  CacheStats
+}
+
+// blockKey identifies a block of a snapshot.  Images are identified by
+// their ID, so that a renamed image and a new image reusing the name do
+// not share blocks.
+type blockKey struct {
+	pool   string
+	image  string
+	snapID uint64
+	block  int64
+}
+
+type cacheEntry struct {
+	key  blockKey
+	data []byte
+}
+
+// CacheStats are the statistics of a BlockCache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Blocks is the number of blocks in the cache.
+	Blocks int
+}
+
+// NewBlockCache returns a cache holding up to size bytes in blocks of
+// blockSize bytes.  On a miss, the readAhead blocks following the missed
+// one are read along with it.
+func NewBlockCache(size int64, blockSize int, readAhead int) *BlockCache {
+	maxBlocks := int(size / int64(blockSize))
+	if maxBlocks < 1 {
+		maxBlocks = 1
+	}
+	if readAhead < 0 {
+		readAhead = 0
+	}
+	return &BlockCache{
+		blockSize: blockSize,
+		maxBlocks: maxBlocks,
+		readAhead: readAhead,
+		lru:       list.New(),
+		blocks:    make(map[blockKey]*list.Element),
+	}
+}
+
+// Stats returns the statistics of the cache.
+func (c *BlockCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Blocks = c.lru.Len()
+	return stats
+}
+
+// get returns the cached block key, if any, and counts the hit or the
+// miss.
+func (c *BlockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+// put caches data as the block key, evicting the least recently used
+// blocks if the cache is full.
+func (c *BlockCache) put(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.blocks[key]; ok {
+		e.Value.(*cacheEntry).data = data
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&cacheEntry{key, data})
+	for c.lru.Len() > c.maxBlocks {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// invalidate drops the cached blocks of a snapshot.
+func (c *BlockCache) invalidate(pool string, image string, snapID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.blocks {
+		if key.pool == pool && key.image == image && key.snapID == snapID {
+			c.lru.Remove(e)
+			delete(c.blocks, key)
+		}
+	}
+}
+
+// CachedImage is an image opened at a snapshot whose reads go through a
+// BlockCache.  The other methods are the ones of the Image.
+type CachedImage struct {
+	*Image
+	cache  *BlockCache
+	id     string
+	snapID uint64
+	size   int64
+}
+
+// Wrap returns img reading through the cache.  img must be opened with
+// the SnapshotName option.  Closing the returned image closes img, but
+// keeps its blocks in the cache.
+func (c *BlockCache) Wrap(img *Image) (*CachedImage, error) {
+	if !img.wantSnapshot {
+		return nil, ErrNotSnapshot
+	}
+	id, err := img.ID()
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := img.ListSnaps()
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range snaps {
+		if snap.Name == img.snapshot {
+			return &CachedImage{img, c, id, snap.ID, int64(snap.Size)}, nil
+		}
+	}
+	return nil, ErrNotSnapshot
+}
+
+func (ci *CachedImage) key(block int64) blockKey {
+	return blockKey{ci.pool, ci.id, ci.snapID, block}
+}
+
+// load reads block and the following read-ahead blocks, and caches them.
+func (ci *CachedImage) load(block int64) ([]byte, error) {
+	blockSize := int64(ci.cache.blockSize)
+	var bufs [][]byte
+	for b := block; b <= block+int64(ci.cache.readAhead) && b*blockSize < ci.size; b++ {
+		length := blockSize
+		if b*blockSize+length > ci.size {
+			length = ci.size - b*blockSize
+		}
+		bufs = append(bufs, make([]byte, length))
+	}
+	if _, err := ci.Image.ReadV(uint64(block*blockSize), bufs); err != nil {
+		return nil, err
+	}
+	for i, buf := range bufs {
+		ci.cache.put(ci.key(block+int64(i)), buf)
+	}
+	return bufs[0], nil
+}
+
+// ReadAt implements the io.ReaderAt interface through the cache.
+func (ci *CachedImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Cannot read image %s at negative offset %d", ci.name, off)
+	}
+	blockSize := int64(ci.cache.blockSize)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= ci.size {
+			return n, io.EOF
+		}
+		block := pos / blockSize
+		data, ok := ci.cache.get(ci.key(block))
+		if !ok {
+			var err error
+			if data, err = ci.load(block); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], data[pos-block*blockSize:])
+	}
+	return n, nil
+}
+
+// InvalidateCache drops the blocks of the snapshot from the cache, and
+// the data cached by librbd.
+func (ci *CachedImage) InvalidateCache() error {
+	ci.cache.invalidate(ci.pool, ci.id, ci.snapID)
+	return ci.Image.InvalidateCache()
+}
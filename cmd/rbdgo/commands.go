@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+	"github.com/sathlan/librbdgo/bench"
+)
+
+func cmdList(c *env, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	names, err := c.r.List()
+	if err != nil {
+		return err
+	}
+	return c.output(names, func() {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	})
+}
+
+func cmdInfo(c *env, args []string) error {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	img, err := c.openImage(args[0], rbd.ReadOnly)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	info, err := img.Stat()
+	if err != nil {
+		return err
+	}
+	features, err := img.Features()
+	if err != nil {
+		return err
+	}
+	oldFormat, err := img.OldFormat()
+	if err != nil {
+		return err
+	}
+	snaps, err := img.ListSnaps()
+	if err != nil {
+		return err
+	}
+	info["name"] = args[0]
+	info["features"] = features
+	info["old_format"] = oldFormat
+	info["snapshot_count"] = len(snaps)
+	return c.output(info, func() {
+		fmt.Printf("rbd image '%s':\n", args[0])
+		fmt.Printf("\tsize %d in %d objects\n", info["size"], info["num_objs"])
+		fmt.Printf("\torder %d (%d bytes objects)\n", info["order"], info["obj_size"])
+		fmt.Printf("\tblock_name_prefix: %s\n", info["block_name_prefix"])
+		fmt.Printf("\tformat: %d\n", map[bool]int{true: 1, false: 2}[oldFormat])
+		fmt.Printf("\tfeatures: %#x\n", features)
+		fmt.Printf("\tsnapshot_count: %d\n", len(snaps))
+	})
+}
+
+func cmdCreate(c *env, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	sizeS := fs.String("size", "", "image size, with an optional K, M, G or T suffix")
+	oldFormat := fs.Bool("old-format", false, "use the old image format")
+	layering := fs.Bool("layering", false, "enable the layering feature")
+	striping := fs.Bool("striping", false, "enable the striping v2 feature")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	size, err := parseSize(*sizeS)
+	if err != nil {
+		return err
+	}
+	var options []func(*rbd.Config) error
+	if *oldFormat {
+		options = append(options, rbd.OldFormat())
+	}
+	if *layering {
+		options = append(options, rbd.Layering())
+	}
+	if *striping {
+		options = append(options, rbd.Stripingv2())
+	}
+	return c.r.Create(args[0], size, options...)
+}
+
+func cmdRemove(c *env, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	return c.r.Remove(args[0])
+}
+
+func cmdRename(c *env, args []string) error {
+	fs := flag.NewFlagSet("rename", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return c.r.Rename(args[0], args[1])
+}
+
+func cmdResize(c *env, args []string) error {
+	fs := flag.NewFlagSet("resize", flag.ContinueOnError)
+	sizeS := fs.String("size", "", "new image size, with an optional K, M, G or T suffix")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	size, err := parseSize(*sizeS)
+	if err != nil {
+		return err
+	}
+	img, err := c.openImage(args[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return img.Resize(size)
+}
+
+func cmdClone(c *env, args []string) error {
+	fs := flag.NewFlagSet("clone", flag.ContinueOnError)
+	layering := fs.Bool("layering", true, "enable the layering feature")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	parent, snap := splitSpec(args[0])
+	if snap == "" {
+		return fmt.Errorf("clone: the parent snapshot is missing in %s", args[0])
+	}
+	var options []func(*rbd.Config) error
+	if *layering {
+		options = append(options, rbd.Layering())
+	}
+	return c.r.Clone(parent, snap, c.r, args[1], options...)
+}
+
+func cmdFlatten(c *env, args []string) error {
+	fs := flag.NewFlagSet("flatten", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	img, err := c.openImage(args[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return img.Flatten()
+}
+
+func cmdSnap(c *env, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("snap: missing sub command")
+	}
+	fs := flag.NewFlagSet("snap "+args[0], flag.ContinueOnError)
+	rest, err := parseArgs(fs, args[1:], 1)
+	if err != nil {
+		return err
+	}
+	name, snap := splitSpec(rest[0])
+	if args[0] != "ls" && snap == "" {
+		return fmt.Errorf("snap %s: the snapshot is missing in %s", args[0], rest[0])
+	}
+	img, err := rbd.NewImage(c.r, name)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	switch args[0] {
+	case "create":
+		return img.CreateSnap(snap)
+	case "rm":
+		return img.RemoveSnap(snap)
+	case "protect":
+		return img.ProtectSnap(snap)
+	case "unprotect":
+		return img.UnProtectSnap(snap)
+	case "rollback":
+		return img.RollbackToSnap(snap)
+	case "ls":
+		snaps, err := img.ListSnaps()
+		if err != nil {
+			return err
+		}
+		return c.output(snaps, func() {
+			fmt.Printf("%6s %-32s %s\n", "SNAPID", "NAME", "SIZE")
+			for _, s := range snaps {
+				fmt.Printf("%6d %-32s %d\n", s.ID, s.Name, s.Size)
+			}
+		})
+	}
+	return fmt.Errorf("snap: unknown sub command %s", args[0])
+}
+
+// lockerInfo is the json representation of a lock.
+type lockerInfo struct {
+	Tag       string     `json:"tag"`
+	Exclusive bool       `json:"exclusive"`
+	Lockers   [][]string `json:"lockers"`
+}
+
+func cmdLock(c *env, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("lock: missing sub command")
+	}
+	fs := flag.NewFlagSet("lock "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "ls":
+		rest, err := parseArgs(fs, args[1:], 1)
+		if err != nil {
+			return err
+		}
+		img, err := c.openImage(rest[0])
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		l, err := img.ListLockers()
+		if err != nil {
+			return err
+		}
+		info := lockerInfo{l.Tag(), l.Exclusive(), l.Lockers()}
+		return c.output(info, func() {
+			if len(info.Lockers) == 0 {
+				return
+			}
+			kind := "shared"
+			if info.Exclusive {
+				kind = "exclusive"
+			}
+			fmt.Printf("There are %d %s locks on this image (tag %q)\n", len(info.Lockers), kind, info.Tag)
+			fmt.Printf("%-20s %-20s %s\n", "Locker", "ID", "Address")
+			for _, locker := range info.Lockers {
+				fmt.Printf("%-20s %-20s %s\n", locker[0], locker[1], locker[2])
+			}
+		})
+	case "add":
+		tag := fs.String("shared", "", "take a shared lock with this tag")
+		rest, err := parseArgs(fs, args[1:], 2)
+		if err != nil {
+			return err
+		}
+		img, err := c.openImage(rest[0])
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		if *tag != "" {
+			return img.LockShared(rest[1], *tag)
+		}
+		return img.LockExclusive(rest[1])
+	case "rm":
+		rest, err := parseArgs(fs, args[1:], 3)
+		if err != nil {
+			return err
+		}
+		img, err := c.openImage(rest[0])
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		return img.BreakLock(rest[1], rest[2])
+	}
+	return fmt.Errorf("lock: unknown sub command %s", args[0])
+}
+
+func cmdChildren(c *env, args []string) error {
+	fs := flag.NewFlagSet("children", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if _, snap := splitSpec(args[0]); snap == "" {
+		return fmt.Errorf("children: the snapshot is missing in %s", args[0])
+	}
+	img, err := c.openImage(args[0])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	children, err := img.ListChildren()
+	if err != nil {
+		return err
+	}
+	return c.output(children, func() {
+		for _, child := range children {
+			for pool, name := range child {
+				fmt.Printf("%s/%s\n", pool, name)
+			}
+		}
+	})
+}
+
+func cmdDiff(c *env, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fromSnap := fs.String("from-snap", "", "only report changes since this snapshot")
+	wholeObject := fs.Bool("whole-object", false, "report whole objects using the object map")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	img, err := c.openImage(args[0], rbd.ReadOnly)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	size, err := img.Size()
+	if err != nil {
+		return err
+	}
+	extents, err := img.ChangedExtents(context.Background(), *fromSnap, 0, size, true, *wholeObject)
+	if err != nil {
+		return err
+	}
+	return c.output(extents, func() {
+		fmt.Printf("%-20s %-20s %s\n", "Offset", "Length", "Type")
+		for _, e := range extents {
+			kind := "zero"
+			if e.Exists {
+				kind = "data"
+			}
+			fmt.Printf("%-20d %-20d %s\n", e.Offset, e.Length, kind)
+		}
+	})
+}
+
+func cmdExport(c *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	img, err := c.openImage(args[0], rbd.ReadOnly)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := rbd.CopySparseToFile(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func cmdImport(c *env, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	layering := fs.Bool("layering", true, "enable the layering feature")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var options []func(*rbd.Config) error
+	if *layering {
+		options = append(options, rbd.Layering())
+	}
+	if err := c.r.Create(args[1], uint64(fi.Size()), options...); err != nil {
+		return err
+	}
+	img, err := rbd.NewImage(c.r, args[1])
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	_, err = rbd.CopySparseFromFile(img, f)
+	return err
+}
+
+func cmdBench(c *env, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	ioType := fs.String("io-type", "write", "read, write or readwrite")
+	pattern := fs.String("io-pattern", "seq", "seq or rand")
+	ioSize := fs.String("io-size", "4K", "size of each I/O")
+	threads := fs.Int("io-threads", bench.DefaultDepth, "number of I/Os in flight")
+	total := fs.String("io-total", "", "total bytes to transfer, 1G unless --duration is set")
+	duration := fs.Duration("duration", 0, "stop after this duration")
+	readPercent := fs.Int("rw-mix-read", 50, "percentage of reads with --io-type readwrite")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	cfg := bench.Config{
+		Pattern:  bench.Pattern(*pattern),
+		Depth:    *threads,
+		Duration: *duration,
+		Seed:     time.Now().UnixNano(),
+	}
+	switch *ioType {
+	case "read":
+		cfg.ReadPercent = 100
+	case "write":
+		cfg.ReadPercent = 0
+	case "readwrite", "rw":
+		cfg.ReadPercent = *readPercent
+	default:
+		return fmt.Errorf("Invalid I/O type %s", *ioType)
+	}
+	size, err := parseSize(*ioSize)
+	if err != nil {
+		return err
+	}
+	cfg.IOSize = int(size)
+	if *total != "" {
+		if cfg.TotalBytes, err = parseSize(*total); err != nil {
+			return err
+		}
+	}
+
+	var options []func(*rbd.Image) error
+	if cfg.ReadPercent == 100 {
+		options = append(options, rbd.ReadOnly)
+	}
+	img, err := c.openImage(args[0], options...)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	res, err := bench.Run(context.Background(), img, cfg)
+	if err != nil {
+		return err
+	}
+	return c.output(res, func() {
+		fmt.Printf("elapsed: %v, io size: %d, threads: %d, pattern: %s\n",
+			res.Elapsed.Round(time.Millisecond), res.Config.IOSize, res.Config.Depth, res.Config.Pattern)
+		fmt.Printf("%-6s %10s %12s %14s %12s %12s %12s %12s\n",
+			"", "ops", "ops/s", "bytes/s", "lat avg", "lat p50", "lat p99", "lat max")
+		for _, s := range []struct {
+			name  string
+			stats bench.Stats
+		}{{"read", res.Read}, {"write", res.Write}, {"total", res.Total}} {
+			l := s.stats.Latency
+			fmt.Printf("%-6s %10d %12.2f %14.2f %12v %12v %12v %12v\n",
+				s.name, s.stats.Ops, s.stats.IOPS, s.stats.Throughput, l.Mean, l.P50, l.P99, l.Max)
+		}
+	})
+}
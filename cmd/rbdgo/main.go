@@ -0,0 +1,186 @@
+// Command rbdgo manages rbd images using the librbdgo package.
+//
+// Usage:
+//
+//	rbdgo [-c ceph.conf] [-n client.admin] [-p pool] [--format plain|json] command [args]
+//
+// Run rbdgo without arguments to get the list of commands.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+// command is a sub command of rbdgo.
+type command struct {
+	usage string
+	run   func(c *env, args []string) error
+}
+
+// env holds the state shared by all the commands.
+type env struct {
+	r      *rbd.Rbd
+	format string
+}
+
+var commands = map[string]command{
+	"ls":       {"ls", cmdList},
+	"info":     {"info image[@snap]", cmdInfo},
+	"create":   {"create --size size [--old-format] [--layering] [--striping] image", cmdCreate},
+	"rm":       {"rm image", cmdRemove},
+	"rename":   {"rename src dest", cmdRename},
+	"resize":   {"resize --size size image", cmdResize},
+	"clone":    {"clone [--layering] parent@snap child", cmdClone},
+	"flatten":  {"flatten image", cmdFlatten},
+	"snap":     {"snap create|rm|ls|protect|unprotect|rollback image[@snap]", cmdSnap},
+	"lock":     {"lock ls image | lock add [--shared tag] image cookie | lock rm image client cookie", cmdLock},
+	"children": {"children image@snap", cmdChildren},
+	"diff":     {"diff [--from-snap snap] [--whole-object] image[@snap]", cmdDiff},
+	"export":   {"export image[@snap] path", cmdExport},
+	"import":   {"import [--layering=false] path image", cmdImport},
+	"bench":    {"bench [--io-type read|write|readwrite] [--io-pattern seq|rand] [--io-size size] [--io-threads n] [--io-total size] [--duration d] [--rw-mix-read pct] image", cmdBench},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: rbdgo [options] command [args]\n\nOptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	conf := flag.String("c", "/etc/ceph/ceph.conf", "ceph configuration file")
+	name := flag.String("n", "client.admin", "ceph user name")
+	pool := flag.String("p", "rbd", "pool name")
+	format := flag.String("format", "plain", "output format, plain or json")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rbdgo: unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if *format != "plain" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "rbdgo: unknown format %s\n", *format)
+		os.Exit(2)
+	}
+
+	conn, err := rbd.NewConn("ceph", *name)
+	if err != nil {
+		fatal(err)
+	}
+	if err := conn.ReadConfigFile(*conf); err != nil {
+		fatal(err)
+	}
+	if err := conn.Connect(); err != nil {
+		fatal(err)
+	}
+	r, err := rbd.NewRbd(conn, *pool)
+	if err != nil {
+		fatal(err)
+	}
+	err = cmd.run(&env{r, *format}, flag.Args()[1:])
+	r.Close()
+	conn.Shutdown()
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "rbdgo: %v\n", err)
+	os.Exit(1)
+}
+
+// output prints v as json, or calls plain when the output format is plain.
+func (c *env) output(v interface{}, plain func()) error {
+	if c.format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	plain()
+	return nil
+}
+
+// splitSpec splits an image[@snap] specification.
+func splitSpec(spec string) (image string, snap string) {
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// openImage opens the image of spec, set to its snapshot if any.
+func (c *env) openImage(spec string, options ...func(*rbd.Image) error) (*rbd.Image, error) {
+	name, snap := splitSpec(spec)
+	if snap != "" {
+		options = append(options, rbd.SnapshotName(snap), rbd.ReadOnly)
+	}
+	return rbd.NewImage(c.r, name, options...)
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T binary
+// suffix.
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("Missing size")
+	}
+	shift := uint(0)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		case "T":
+			shift = 40
+		}
+		if shift != 0 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size %s: %v", s, err)
+	}
+	if size > math.MaxUint64>>shift {
+		return 0, fmt.Errorf("Invalid size %s: value out of range", s)
+	}
+	return size << shift, nil
+}
+
+// parseArgs parses the flags of a command and checks the number of
+// remaining arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		return nil, fmt.Errorf("%s: expected %d arguments, got %d", fs.Name(), n, fs.NArg())
+	}
+	return fs.Args(), nil
+}
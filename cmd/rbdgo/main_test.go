@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_parseSize(t *testing.T) {
+	tests := map[string]uint64{
+		"42":  42,
+		"1K":  1024,
+		"5M":  5 * 1024 * 1024,
+		"2g":  2 * 1024 * 1024 * 1024,
+		"1T":  1024 * 1024 * 1024 * 1024,
+		"10k": 10 * 1024,
+	}
+	for s, expected := range tests {
+		size, err := parseSize(s)
+		if err != nil || size != expected {
+			t.Errorf("Wrong size for %s, expected %d, got %d (%v)", s, expected, size, err)
+		}
+	}
+	for _, s := range []string{"", "M", "12X", "-1", "16777216T", "18446744073709551615K"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("Size %q should be invalid", s)
+		}
+	}
+}
+
+func Test_splitSpec(t *testing.T) {
+	tests := map[string][2]string{
+		"image":           {"image", ""},
+		"image@snap":      {"image", "snap"},
+		"image@":          {"image", ""},
+		"image@snap@last": {"image@snap", "last"},
+	}
+	for spec, expected := range tests {
+		if image, snap := splitSpec(spec); image != expected[0] || snap != expected[1] {
+			t.Errorf("Wrong split of %s, expected %v, got %s %s", spec, expected, image, snap)
+		}
+	}
+}
+
+func Test_commandsUsage(t *testing.T) {
+	for name, cmd := range commands {
+		if !strings.HasPrefix(cmd.usage, name+" ") && cmd.usage != name {
+			t.Errorf("Usage of %s does not start with its name: %s", name, cmd.usage)
+		}
+	}
+}
+
+// Test_commandsArgs checks the arguments validated before any call to the
+// cluster, so the commands run without a connection.
+func Test_commandsArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"ls", "extra"}, "expected 0 arguments"},
+		{[]string{"create", "image"}, "Missing size"},
+		{[]string{"create", "--size", "1X", "image"}, "Invalid size"},
+		{[]string{"create", "--size", "99999999T", "image"}, "out of range"},
+		{[]string{"create", "--size", "1G"}, "expected 1 arguments"},
+		{[]string{"resize", "image"}, "Missing size"},
+		{[]string{"rm"}, "expected 1 arguments"},
+		{[]string{"rename", "src"}, "expected 2 arguments"},
+		{[]string{"clone", "parent", "child"}, "parent snapshot is missing"},
+		{[]string{"snap"}, "missing sub command"},
+		{[]string{"snap", "create", "image"}, "snapshot is missing"},
+		{[]string{"lock"}, "missing sub command"},
+		{[]string{"lock", "steal", "image"}, "unknown sub command"},
+		{[]string{"children", "image"}, "snapshot is missing"},
+		{[]string{"export", "image"}, "expected 2 arguments"},
+		{[]string{"bench", "--io-type", "scan", "image"}, "Invalid I/O type"},
+		{[]string{"bench", "--io-size", "4X", "image"}, "Invalid size"},
+	}
+	for _, test := range tests {
+		err := commands[test.args[0]].run(&env{format: "plain"}, test.args[1:])
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Wrong error for %v, expected %q, got %v", test.args, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+*/
+import "C"
+import "fmt"
+import "unsafe"
+import "context"
+import "time"
+
+// confPrefix is the metadata key prefix librbd reads configuration
+// overrides from.
+const confPrefix = "conf_"
+
+// ConfigSource tells where the value of a configuration option comes from.
+type ConfigSource int
+
+const (
+	// ConfigSourceConfig is a value from the ceph configuration.
+	ConfigSourceConfig ConfigSource = C.RBD_CONFIG_SOURCE_CONFIG
+	// ConfigSourcePool is a value overridden at the pool level.
+	ConfigSourcePool ConfigSource = C.RBD_CONFIG_SOURCE_POOL
+	// ConfigSourceImage is a value overridden at the image level.
+	ConfigSourceImage ConfigSource = C.RBD_CONFIG_SOURCE_IMAGE
+)
+
+// String implements the stringer interface for ConfigSource.
+func (s ConfigSource) String() string {
+	switch s {
+	case ConfigSourceConfig:
+		return "config"
+	case ConfigSourcePool:
+		return "pool"
+	case ConfigSourceImage:
+		return "image"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// ConfigOption is the effective value of a librbd configuration option.
+type ConfigOption struct {
+	Name   string
+	Value  string
+	Source ConfigSource
+}
+
+func configOptions(optionsC []C.rbd_config_option_t) []ConfigOption {
+	res := make([]ConfigOption, len(optionsC))
+	for i, o := range optionsC {
+		res[i] = ConfigOption{
+			Name:   C.GoString(o.name),
+			Value:  C.GoString(o.value),
+			Source: ConfigSource(o.source),
+		}
+	}
+	return res
+}
+
+// ConfigList lists the librbd configuration options applied to the image
+// along with their source.
+func (img *Image) ConfigList() ([]ConfigOption, error) {
+	return img.ConfigListContext(context.Background())
+}
+
+// ConfigListContext is ConfigList passing ctx to the observer.
+func (img *Image) ConfigListContext(ctx context.Context) (_ []ConfigOption, err error) {
+	defer img.observe(ctx, "config_list", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return nil, err
+	}
+	defer img.unlock()
+	maxC := C.int(64)
+	var optionsC []C.rbd_config_option_t
+	var retC C.int
+	for {
+		optionsC = make([]C.rbd_config_option_t, int(maxC))
+		retC = C.rbd_config_image_list(img.getC(), &optionsC[0], &maxC)
+		if retC != -C.ERANGE {
+			break
+		}
+	}
+	if retC < 0 {
+		return nil, &cError{fmt.Sprintf("Cannot list configuration of image %s", img.name), 0, retC}
+	}
+	defer C.rbd_config_image_list_cleanup(&optionsC[0], maxC)
+	return configOptions(optionsC[:int(maxC)]), nil
+}
+
+// SetConfig overrides a librbd configuration option, like
+// rbd_qos_iops_limit or rbd_cache, for this image only.
+func (img *Image) SetConfig(key string, value string) error {
+	return img.SetConfigContext(context.Background(), key, value)
+}
+
+// SetConfigContext is SetConfig passing ctx to the observer.
+func (img *Image) SetConfigContext(ctx context.Context, key string, value string) (err error) {
+	defer img.observe(ctx, "set_config", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	keyC := C.CString(confPrefix + key)
+	defer C.free(unsafe.Pointer(keyC))
+	valueC := C.CString(value)
+	defer C.free(unsafe.Pointer(valueC))
+
+	retC := C.rbd_metadata_set(img.getC(), keyC, valueC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot set configuration %s of image %s", key, img.name), 0, retC}
+	}
+	return nil
+}
+
+// RemoveConfig removes an image level override of a configuration option.
+func (img *Image) RemoveConfig(key string) error {
+	return img.RemoveConfigContext(context.Background(), key)
+}
+
+// RemoveConfigContext is RemoveConfig passing ctx to the observer.
+func (img *Image) RemoveConfigContext(ctx context.Context, key string) (err error) {
+	defer img.observe(ctx, "remove_config", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	keyC := C.CString(confPrefix + key)
+	defer C.free(unsafe.Pointer(keyC))
+
+	retC := C.rbd_metadata_remove(img.getC(), keyC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot remove configuration %s of image %s", key, img.name), 0, retC}
+	}
+	return nil
+}
+
+// PoolConfigList lists the librbd configuration options applied to the
+// pool along with their source.
+func (r *Rbd) PoolConfigList() ([]ConfigOption, error) {
+	return r.PoolConfigListContext(context.Background())
+}
+
+// PoolConfigListContext is PoolConfigList passing ctx to the observer.
+func (r *Rbd) PoolConfigListContext(ctx context.Context) (_ []ConfigOption, err error) {
+	defer r.observe(ctx, "pool_config_list", "", time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+	maxC := C.int(64)
+	var optionsC []C.rbd_config_option_t
+	var retC C.int
+	for {
+		optionsC = make([]C.rbd_config_option_t, int(maxC))
+		retC = C.rbd_config_pool_list(r.GetHandle(), &optionsC[0], &maxC)
+		if retC != -C.ERANGE {
+			break
+		}
+	}
+	if retC < 0 {
+		return nil, &cError{fmt.Sprintf("Cannot list configuration of pool %s", r.PoolName), 0, retC}
+	}
+	defer C.rbd_config_pool_list_cleanup(&optionsC[0], maxC)
+	return configOptions(optionsC[:int(maxC)]), nil
+}
+
+// SetPoolConfig overrides a librbd configuration option for every image
+// of the pool.
+func (r *Rbd) SetPoolConfig(key string, value string) error {
+	return r.SetPoolConfigContext(context.Background(), key, value)
+}
+
+// SetPoolConfigContext is SetPoolConfig passing ctx to the observer.
+func (r *Rbd) SetPoolConfigContext(ctx context.Context, key string, value string) (err error) {
+	defer r.observe(ctx, "set_pool_config", "", time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
+	keyC := C.CString(confPrefix + key)
+	defer C.free(unsafe.Pointer(keyC))
+	valueC := C.CString(value)
+	defer C.free(unsafe.Pointer(valueC))
+
+	retC := C.rbd_pool_metadata_set(r.GetHandle(), keyC, valueC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot set configuration %s of pool %s", key, r.PoolName), 0, retC}
+	}
+	return nil
+}
+
+// RemovePoolConfig removes a pool level override of a configuration option.
+func (r *Rbd) RemovePoolConfig(key string) error {
+	return r.RemovePoolConfigContext(context.Background(), key)
+}
+
+// RemovePoolConfigContext is RemovePoolConfig passing ctx to the observer.
+func (r *Rbd) RemovePoolConfigContext(ctx context.Context, key string) (err error) {
+	defer r.observe(ctx, "remove_pool_config", "", time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
+	keyC := C.CString(confPrefix + key)
+	defer C.free(unsafe.Pointer(keyC))
+
+	retC := C.rbd_pool_metadata_remove(r.GetHandle(), keyC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot remove configuration %s of pool %s", key, r.PoolName), 0, retC}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+*/
+import "C"
+import "fmt"
+import "runtime"
+import "sync"
+import "unsafe"
+
+// Conn is a connection to a ceph cluster.  It implements
+// IoCtxCreateDestroyer, so that it can be given to NewRbd without
+// depending on another rados binding.
+type Conn struct {
+	mu        sync.Mutex
+	cluster   C.rados_t
+	connected bool
+	shutdown  bool
+	openedAt  string
+	// ioctxs are the ioctx created by IoCtxCreate, by the handle
+	// returned for them.
+	ioctxs map[uintptr]C.rados_ioctx_t
+}
+
+// NewConn creates a connection handle for the user name, like
+// "client.admin", of the cluster clusterName, usually "ceph".  The
+// configuration must be read or set before calling Connect.
+func NewConn(clusterName string, name string) (*Conn, error) {
+	clusterNameC := C.CString(clusterName)
+	defer C.free(unsafe.Pointer(clusterNameC))
+	nameC := C.CString(name)
+	defer C.free(unsafe.Pointer(nameC))
+
+	c := &Conn{openedAt: caller(), ioctxs: make(map[uintptr]C.rados_ioctx_t)}
+	retC := C.rados_create2(&c.cluster, clusterNameC, nameC, 0)
+	if retC < 0 {
+		return nil, &cError{fmt.Sprintf("Cannot create connection to cluster %s as %s", clusterName, name), 0, retC}
+	}
+	runtime.SetFinalizer(c, leakedConn)
+	return c, nil
+}
+
+func leakedConn(c *Conn) {
+	if !c.shutdown {
+		warnLeak("connection opened at %s was not shut down", c.openedAt)
+	}
+}
+
+// ReadConfigFile reads the configuration file path.  An empty path reads
+// the default configuration files.
+func (c *Conn) ReadConfigFile(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return ErrClosed
+	}
+	var pathC *C.char
+	if path != "" {
+		pathC = C.CString(path)
+		defer C.free(unsafe.Pointer(pathC))
+	}
+	retC := C.rados_conf_read_file(c.cluster, pathC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot read configuration file %s", path), 0, retC}
+	}
+	return nil
+}
+
+// SetConfig sets the configuration option to value.
+func (c *Conn) SetConfig(option string, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return ErrClosed
+	}
+	optionC := C.CString(option)
+	defer C.free(unsafe.Pointer(optionC))
+	valueC := C.CString(value)
+	defer C.free(unsafe.Pointer(valueC))
+	retC := C.rados_conf_set(c.cluster, optionC, valueC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot set configuration %s to %s", option, value), 0, retC}
+	}
+	return nil
+}
+
+// Connect connects to the cluster.
+func (c *Conn) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return ErrClosed
+	}
+	retC := C.rados_connect(c.cluster)
+	if retC < 0 {
+		return &cError{"Cannot connect to the cluster", 0, retC}
+	}
+	c.connected = true
+	return nil
+}
+
+// IoCtxCreate creates an ioctx for the pool poolName.
+func (c *Conn) IoCtxCreate(poolName string) (uintptr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return 0, ErrClosed
+	}
+	if !c.connected {
+		return 0, fmt.Errorf("Cannot open pool %s: not connected", poolName)
+	}
+	poolNameC := C.CString(poolName)
+	defer C.free(unsafe.Pointer(poolNameC))
+	var ioctx C.rados_ioctx_t
+	retC := C.rados_ioctx_create(c.cluster, poolNameC, &ioctx)
+	if retC < 0 {
+		return 0, &cError{fmt.Sprintf("Cannot open pool %s", poolName), 0, retC}
+	}
+	handle := uintptr(unsafe.Pointer(ioctx))
+	c.ioctxs[handle] = ioctx
+	return handle, nil
+}
+
+// IoCtxDestroy destroys an ioctx created by IoCtxCreate.  Destroying an
+// unknown ioctx, or an ioctx already destroyed by Shutdown, does nothing.
+func (c *Conn) IoCtxDestroy(ctx uintptr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ioctx, ok := c.ioctxs[ctx]
+	if !ok {
+		return
+	}
+	delete(c.ioctxs, ctx)
+	C.rados_ioctx_destroy(ioctx)
+}
+
+// Shutdown closes the connection.  The Rbd opened with c must be closed
+// first: the ioctx still open are destroyed.  Shutting down a connection
+// twice does nothing.
+func (c *Conn) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return
+	}
+	c.shutdown = true
+	runtime.SetFinalizer(c, nil)
+	for handle, ioctx := range c.ioctxs {
+		C.rados_ioctx_destroy(ioctx)
+		delete(c.ioctxs, handle)
+	}
+	C.rados_shutdown(c.cluster)
+}
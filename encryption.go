@@ -0,0 +1,171 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+*/
+import "C"
+import "fmt"
+import "unsafe"
+import "context"
+import "time"
+
+// EncryptionFormat identifies the on-disk encryption header of an image.
+type EncryptionFormat int
+
+const (
+	// EncryptionFormatLUKS1 is the LUKS version 1 header.
+	EncryptionFormatLUKS1 EncryptionFormat = C.RBD_ENCRYPTION_FORMAT_LUKS1
+	// EncryptionFormatLUKS2 is the LUKS version 2 header.
+	EncryptionFormatLUKS2 EncryptionFormat = C.RBD_ENCRYPTION_FORMAT_LUKS2
+	// EncryptionFormatLUKS detects the LUKS version when loading.  It
+	// cannot be used to format an image.
+	EncryptionFormatLUKS EncryptionFormat = C.RBD_ENCRYPTION_FORMAT_LUKS
+)
+
+// EncryptionConfig holds the parameters used to format an encrypted image.
+type EncryptionConfig struct {
+	algorithm C.rbd_encryption_algorithm_t
+}
+
+// EncryptionSpec describes how to unlock one image in a clone chain.
+type EncryptionSpec struct {
+	Format     EncryptionFormat
+	Passphrase []byte
+}
+
+func (c *EncryptionConfig) setAlgorithm(alg C.rbd_encryption_algorithm_t) error {
+	c.algorithm = alg
+	return nil
+}
+
+// AES128 is a configuration option for EncryptionFormat.
+func AES128() func(*EncryptionConfig) error {
+	return func(c *EncryptionConfig) error {
+		return c.setAlgorithm(C.RBD_ENCRYPTION_ALGORITHM_AES128)
+	}
+}
+
+// AES256 is a configuration option for EncryptionFormat.  This is the
+// default.
+func AES256() func(*EncryptionConfig) error {
+	return func(c *EncryptionConfig) error {
+		return c.setAlgorithm(C.RBD_ENCRYPTION_ALGORITHM_AES256)
+	}
+}
+
+// encryptionOpts allocates in C memory the options structure matching
+// format.  The returned function releases it.
+func encryptionOpts(format EncryptionFormat, passphrase []byte, config *EncryptionConfig) (C.rbd_encryption_options_t, C.size_t, func(), error) {
+	passC := (*C.char)(C.CBytes(passphrase))
+	passLenC := C.size_t(len(passphrase))
+	var optsC unsafe.Pointer
+	var sizeC C.size_t
+	switch format {
+	case EncryptionFormatLUKS1:
+		sizeC = C.sizeof_rbd_encryption_luks1_format_options_t
+		optsC = C.malloc(sizeC)
+		opts := (*C.rbd_encryption_luks1_format_options_t)(optsC)
+		opts.alg = config.algorithm
+		opts.passphrase = passC
+		opts.passphrase_size = passLenC
+	case EncryptionFormatLUKS2:
+		sizeC = C.sizeof_rbd_encryption_luks2_format_options_t
+		optsC = C.malloc(sizeC)
+		opts := (*C.rbd_encryption_luks2_format_options_t)(optsC)
+		opts.alg = config.algorithm
+		opts.passphrase = passC
+		opts.passphrase_size = passLenC
+	case EncryptionFormatLUKS:
+		sizeC = C.sizeof_rbd_encryption_luks_format_options_t
+		optsC = C.malloc(sizeC)
+		opts := (*C.rbd_encryption_luks_format_options_t)(optsC)
+		opts.passphrase = passC
+		opts.passphrase_size = passLenC
+	default:
+		C.free(unsafe.Pointer(passC))
+		return nil, 0, nil, fmt.Errorf("Unknown encryption format %d", format)
+	}
+	free := func() {
+		C.free(optsC)
+		C.free(unsafe.Pointer(passC))
+	}
+	return C.rbd_encryption_options_t(optsC), sizeC, free, nil
+}
+
+// EncryptionFormat writes an encryption header to the image.  Unless the
+// image is a clone, the encryption layer is loaded on the handle as well,
+// and EncryptionLoad must not be called on it.  A clone must be reopened
+// and EncryptionLoad called before data can be accessed through the
+// encryption layer.
+func (img *Image) EncryptionFormat(format EncryptionFormat, passphrase []byte, options ...func(*EncryptionConfig) error) error {
+	return img.EncryptionFormatContext(context.Background(), format, passphrase, options...)
+}
+
+// EncryptionFormatContext is EncryptionFormat passing ctx to the observer.
+func (img *Image) EncryptionFormatContext(ctx context.Context, format EncryptionFormat, passphrase []byte, options ...func(*EncryptionConfig) error) (err error) {
+	defer img.observe(ctx, "encryption_format", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	if format == EncryptionFormatLUKS {
+		return fmt.Errorf("Cannot format image %s: a LUKS version must be given", img.name)
+	}
+	config := &EncryptionConfig{algorithm: C.RBD_ENCRYPTION_ALGORITHM_AES256}
+	for _, option := range options {
+		option(config)
+	}
+	optsC, sizeC, free, err := encryptionOpts(format, passphrase, config)
+	if err != nil {
+		return err
+	}
+	defer free()
+
+	retC := C.rbd_encryption_format(img.getC(), C.rbd_encryption_format_t(format), optsC, sizeC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot format encryption of image %s", img.name), 0, retC}
+	}
+	return nil
+}
+
+// EncryptionLoad enables the encryption layer of the image, so that Read
+// and Write transparently decrypt and encrypt data.  When the image is a
+// clone whose ancestors use different passphrases, their specifications
+// are given in parents, from the nearest parent to the farthest one.
+func (img *Image) EncryptionLoad(format EncryptionFormat, passphrase []byte, parents ...EncryptionSpec) error {
+	return img.EncryptionLoadContext(context.Background(), format, passphrase, parents...)
+}
+
+// EncryptionLoadContext is EncryptionLoad passing ctx to the observer.
+func (img *Image) EncryptionLoadContext(ctx context.Context, format EncryptionFormat, passphrase []byte, parents ...EncryptionSpec) (err error) {
+	defer img.observe(ctx, "encryption_load", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	specs := append([]EncryptionSpec{{format, passphrase}}, parents...)
+	config := &EncryptionConfig{}
+	countC := C.size_t(len(specs))
+	specsC := (*[1 << 16]C.rbd_encryption_spec_t)(C.malloc(countC * C.sizeof_rbd_encryption_spec_t))[:len(specs):len(specs)]
+	defer C.free(unsafe.Pointer(&specsC[0]))
+	for i, spec := range specs {
+		optsC, sizeC, free, err := encryptionOpts(spec.Format, spec.Passphrase, config)
+		if err != nil {
+			return err
+		}
+		defer free()
+		specsC[i].format = C.rbd_encryption_format_t(spec.Format)
+		specsC[i].opts = optsC
+		specsC[i].opts_size = sizeC
+	}
+
+	retC := C.rbd_encryption_load2(img.getC(), &specsC[0], countC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot load encryption of image %s", img.name), 0, retC}
+	}
+	return nil
+}
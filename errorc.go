@@ -4,7 +4,9 @@ package rbd
 #include <errno.h>
 */
 import "C"
+import "errors"
 import "fmt"
+import "syscall"
 
 // https://code.google.com/p/go/issues/detail?id=435
 
@@ -33,10 +35,28 @@ func (e *cError) Error() (errorMsg string) {
 		-C.EBUSY:    "Snap is not protected",
 	}
 
-	if msg, ok := errorC[e.got]; !ok {
+	msg, ok := errorC[e.got]
+	if !ok && e.got < 0 {
+		// librbd returns negative error numbers
+		msg, ok = errorC[-e.got]
+	}
+	if !ok {
 		errorMsg = fmt.Sprintf("%s: unknown error %d (expected %d)", e.msg, int(e.got), e.want)
 	} else {
 		errorMsg = fmt.Sprintf("%s: expected %d, got %s (%d)", e.msg, e.want, msg, int(e.got))
 	}
 	return
 }
+
+// Errno returns the error number reported by librbd when err comes from a
+// failed librbd call.
+func Errno(err error) (syscall.Errno, bool) {
+	var e *cError
+	if !errors.As(err, &e) {
+		return 0, false
+	}
+	if e.got < 0 {
+		return syscall.Errno(-e.got), true
+	}
+	return syscall.Errno(e.got), true
+}
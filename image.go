@@ -10,8 +10,8 @@ package rbd
 
 extern int goDiffCB(uint64_t, size_t, int, void *);
 
-static int goDiffIter(rbd_image_t imageHandle, const char *snapName, uint64_t offset, uint64_t len, void* userdata) {
-   return rbd_diff_iterate(imageHandle, snapName, offset, len, goDiffCB, userdata);
+static int goDiffIter2(rbd_image_t imageHandle, const char *snapName, uint64_t offset, uint64_t len, uint8_t includeParent, uint8_t wholeObject, uintptr_t handle) {
+   return rbd_diff_iterate2(imageHandle, snapName, offset, len, includeParent, wholeObject, goDiffCB, (void *)handle);
 }
 
 */
@@ -20,15 +20,28 @@ import "unsafe"
 import "fmt"
 import "reflect"
 import "io"
-
-// Image holds the C structure and information about the block device.
+import "context"
+import "runtime"
+import "runtime/cgo"
+import "sync"
+import "time"
+
+// Image holds the C structure and information about the block device.  It
+// is safe for concurrent use.  Its methods return ErrClosed once it is
+// closed.
 type Image struct {
+	mu           sync.RWMutex
 	closed       bool
+	openedAt     string
 	name         string
 	readOnly     bool
 	snapshot     string
 	wantSnapshot bool
 	c            uintptr
+	pool         string
+	observer     Observer
+	// inflight counts the vectored I/Os submitted and not waited for.
+	inflight sync.WaitGroup
 }
 
 // Locker describes all the locker attached to a block device
@@ -43,14 +56,37 @@ const (
 	LayeringMask uint64 = 1 << iota
 	//Stripingv2Mask is the equivalent of the C data in go.
 	Stripingv2Mask
+	//ExclusiveLockMask is the equivalent of the C data in go.
+	ExclusiveLockMask
+	//ObjectMapMask is the equivalent of the C data in go.
+	ObjectMapMask
+	//FastDiffMask is the equivalent of the C data in go.
+	FastDiffMask
 )
 
+// SnapInfo describes a snapshot of an image.
+type SnapInfo struct {
+	ID   uint64
+	Size uint64
+	Name string
+}
+
 // NewImage is the entry point for block device manipulation.
 func NewImage(rados IoCtxGetter, name string, options ...func(*Image) error) (*Image, error) {
+	return newImage(context.Background(), rados, name, caller(), options...)
+}
+
+// NewImageContext is NewImage passing ctx to the observer of rados when
+// it is an *Rbd.
+func NewImageContext(ctx context.Context, rados IoCtxGetter, name string, options ...func(*Image) error) (*Image, error) {
+	return newImage(ctx, rados, name, caller(), options...)
+}
+
+func newImage(ctx context.Context, rados IoCtxGetter, name string, openedAt string, options ...func(*Image) error) (_ *Image, err error) {
 	var imgC C.rbd_image_t
-	img := Image{closed: true, name: name, wantSnapshot: false}
+	img := &Image{closed: true, name: name, wantSnapshot: false, openedAt: openedAt}
 	for _, option := range options {
-		option(&img)
+		option(img)
 	}
 	nameC := C.CString(name)
 	defer C.free(unsafe.Pointer(nameC))
@@ -59,8 +95,24 @@ func NewImage(rados IoCtxGetter, name string, options ...func(*Image) error) (*I
 		snapNameC = C.CString(img.snapshot)
 	}
 	defer C.free(unsafe.Pointer(snapNameC))
-	ctx, _ := rados.IoCtxGet()
-	ctxC := (C.rados_ioctx_t)(ctx)
+	var ioctx uintptr
+	if r, ok := rados.(*Rbd); ok {
+		// Keep r open while the image is opened.
+		if err := r.lock(); err != nil {
+			return nil, err
+		}
+		defer r.unlock()
+		ioctx = r.ctx
+		img.pool = r.PoolName
+		img.observer = r.observer
+		defer img.observe(ctx, "open", time.Now(), nil, &err)
+	} else {
+		var err error
+		if ioctx, err = rados.IoCtxGet(); err != nil {
+			return nil, err
+		}
+	}
+	ctxC := (C.rados_ioctx_t)(ioctx)
 	var errC C.int
 	if img.readOnly == true {
 		errC = C.rbd_open_read_only(ctxC, nameC, &imgC, snapNameC)
@@ -74,7 +126,9 @@ func NewImage(rados IoCtxGetter, name string, options ...func(*Image) error) (*I
 		return nil, &cError{fmt.Sprintf("Cannot Open image %s", name), 0, errC}
 	}
 	img.c = reflect.ValueOf(imgC).Pointer()
-	return &img, nil
+	img.closed = false
+	runtime.SetFinalizer(img, leakedImage)
+	return img, nil
 }
 
 func (img *Image) getC() C.rbd_image_t {
@@ -83,18 +137,52 @@ func (img *Image) getC() C.rbd_image_t {
 	return (C.rbd_image_t)(img.c)
 }
 
-// Close the associated image.
+// IsReadOnly tells whether the image was opened with the ReadOnly option
+// or at a snapshot.
+func (img *Image) IsReadOnly() bool {
+	return img.readOnly || img.wantSnapshot
+}
+
+// Close the associated image.  It waits for the calls in progress, and
+// for the Wait of the vectored I/Os submitted.  Closing a closed image
+// does nothing.
 func (img *Image) Close() error {
+	return img.CloseContext(context.Background())
+}
+
+// CloseContext is Close passing ctx to the observer.
+func (img *Image) CloseContext(ctx context.Context) (err error) {
+	defer img.observe(ctx, "close", time.Now(), nil, &err)
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.closed {
+		return nil
+	}
+	// librbd must not be closed with I/Os in flight.
+	img.inflight.Wait()
 	retC := C.rbd_close(img.getC())
 
 	if retC != 0 {
 		return &cError{fmt.Sprintf("Cannot close image %s", img.name), 0, retC}
 	}
+	img.closed = true
+	img.c = 0
+	runtime.SetFinalizer(img, nil)
 	return nil
 }
 
 // Stat gets information about the image.
 func (img *Image) Stat() (map[string]interface{}, error) {
+	return img.StatContext(context.Background())
+}
+
+// StatContext is Stat passing ctx to the observer.
+func (img *Image) StatContext(ctx context.Context) (_ map[string]interface{}, err error) {
+	defer img.observe(ctx, "stat", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return nil, err
+	}
+	defer img.unlock()
 	var infoC C.rbd_image_info_t
 	retC := C.rbd_stat(img.getC(), &infoC, C.size_t(unsafe.Sizeof(infoC)))
 	if retC != 0 {
@@ -113,8 +201,46 @@ func (img *Image) Stat() (map[string]interface{}, error) {
 	}, nil
 }
 
+// ID gets the identifier of the image, which unlike its name does not
+// change when the image is renamed.
+func (img *Image) ID() (string, error) {
+	return img.IDContext(context.Background())
+}
+
+// IDContext is ID passing ctx to the observer.
+func (img *Image) IDContext(ctx context.Context) (_ string, err error) {
+	defer img.observe(ctx, "get_id", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return "", err
+	}
+	defer img.unlock()
+	var id []byte
+	var retC C.int
+	for size := 32; ; size *= 2 {
+		id = make([]byte, size)
+		retC = C.rbd_get_id(img.getC(), (*C.char)(unsafe.Pointer(&id[0])), C.size_t(size))
+		if retC != -C.ERANGE {
+			break
+		}
+	}
+	if retC < 0 {
+		return "", &cError{fmt.Sprintf("Cannot get the id of image %s", img.name), 0, retC}
+	}
+	return C.GoString((*C.char)(unsafe.Pointer(&id[0]))), nil
+}
+
 // Resize changes the size of the image.
 func (img *Image) Resize(newSize uint64) error {
+	return img.ResizeContext(context.Background(), newSize)
+}
+
+// ResizeContext is Resize passing ctx to the observer.
+func (img *Image) ResizeContext(ctx context.Context, newSize uint64) (err error) {
+	defer img.observe(ctx, "resize", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	retC := C.rbd_resize(img.getC(), C.uint64_t(newSize))
 	if retC < 0 {
 		return &cError{fmt.Sprintf("Cannot resize image %s to %d", img.name, newSize), 0, retC}
@@ -124,6 +250,16 @@ func (img *Image) Resize(newSize uint64) error {
 
 // ParentInfo gets information about a cloned image's parent.
 func (img *Image) ParentInfo() (map[string]string, error) {
+	return img.ParentInfoContext(context.Background())
+}
+
+// ParentInfoContext is ParentInfo passing ctx to the observer.
+func (img *Image) ParentInfoContext(ctx context.Context) (_ map[string]string, err error) {
+	defer img.observe(ctx, "parent_info", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return nil, err
+	}
+	defer img.unlock()
 	size := 8
 	retC := (C.int)(-C.ERANGE)
 	var poolC *C.char
@@ -162,6 +298,16 @@ func (img *Image) ParentInfo() (map[string]string, error) {
 
 // OldFormat determines whether the image uses the old RBD format.
 func (img *Image) OldFormat() (bool, error) {
+	return img.OldFormatContext(context.Background())
+}
+
+// OldFormatContext is OldFormat passing ctx to the observer.
+func (img *Image) OldFormatContext(ctx context.Context) (_ bool, err error) {
+	defer img.observe(ctx, "old_format", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return false, err
+	}
+	defer img.unlock()
 	var old C.uint8_t
 
 	retC := C.rbd_get_old_format(img.getC(), &old)
@@ -173,6 +319,16 @@ func (img *Image) OldFormat() (bool, error) {
 
 // Size gets the size of the image.
 func (img *Image) Size() (size uint64, err error) {
+	return img.SizeContext(context.Background())
+}
+
+// SizeContext is Size passing ctx to the observer.
+func (img *Image) SizeContext(ctx context.Context) (size uint64, err error) {
+	defer img.observe(ctx, "size", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
 	var image_size C.uint64_t
 
 	retC := C.rbd_get_size(img.getC(), &image_size)
@@ -184,6 +340,16 @@ func (img *Image) Size() (size uint64, err error) {
 
 // Features gets the features bitmask of the image.
 func (img *Image) Features() (mask uint64, err error) {
+	return img.FeaturesContext(context.Background())
+}
+
+// FeaturesContext is Features passing ctx to the observer.
+func (img *Image) FeaturesContext(ctx context.Context) (mask uint64, err error) {
+	defer img.observe(ctx, "features", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
 	var featuresC C.uint64_t
 
 	retC := C.rbd_get_features(img.getC(), &featuresC)
@@ -196,6 +362,16 @@ func (img *Image) Features() (mask uint64, err error) {
 
 // CreateSnap creates a snapshot of the image.
 func (img *Image) CreateSnap(snapName string) error {
+	return img.CreateSnapContext(context.Background(), snapName)
+}
+
+// CreateSnapContext is CreateSnap passing ctx to the observer.
+func (img *Image) CreateSnapContext(ctx context.Context, snapName string) (err error) {
+	defer img.observe(ctx, "create_snap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	snapNameC := C.CString(snapName)
 	defer C.free(unsafe.Pointer(snapNameC))
 
@@ -208,6 +384,16 @@ func (img *Image) CreateSnap(snapName string) error {
 
 // RemoveSnap deletes a snapshot of the image.
 func (img *Image) RemoveSnap(snapName string) error {
+	return img.RemoveSnapContext(context.Background(), snapName)
+}
+
+// RemoveSnapContext is RemoveSnap passing ctx to the observer.
+func (img *Image) RemoveSnapContext(ctx context.Context, snapName string) (err error) {
+	defer img.observe(ctx, "remove_snap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	snapNameC := C.CString(snapName)
 	defer C.free(unsafe.Pointer(snapNameC))
 
@@ -220,6 +406,16 @@ func (img *Image) RemoveSnap(snapName string) error {
 
 // RollbackToSnap reverts the image to its contents at a snapshot.
 func (img *Image) RollbackToSnap(snapName string) error {
+	return img.RollbackToSnapContext(context.Background(), snapName)
+}
+
+// RollbackToSnapContext is RollbackToSnap passing ctx to the observer.
+func (img *Image) RollbackToSnapContext(ctx context.Context, snapName string) (err error) {
+	defer img.observe(ctx, "rollback_snap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	snapNameC := C.CString(snapName)
 	defer C.free(unsafe.Pointer(snapNameC))
 
@@ -232,6 +428,16 @@ func (img *Image) RollbackToSnap(snapName string) error {
 
 // ProtectSnap marks a snapshot as protected.
 func (img *Image) ProtectSnap(snapName string) error {
+	return img.ProtectSnapContext(context.Background(), snapName)
+}
+
+// ProtectSnapContext is ProtectSnap passing ctx to the observer.
+func (img *Image) ProtectSnapContext(ctx context.Context, snapName string) (err error) {
+	defer img.observe(ctx, "protect_snap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	snapNameC := C.CString(snapName)
 	defer C.free(unsafe.Pointer(snapNameC))
 
@@ -244,6 +450,16 @@ func (img *Image) ProtectSnap(snapName string) error {
 
 // UnProtectSnap marks a snapshot as unprotected.
 func (img *Image) UnProtectSnap(snapName string) error {
+	return img.UnProtectSnapContext(context.Background(), snapName)
+}
+
+// UnProtectSnapContext is UnProtectSnap passing ctx to the observer.
+func (img *Image) UnProtectSnapContext(ctx context.Context, snapName string) (err error) {
+	defer img.observe(ctx, "unprotect_snap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	snapNameC := C.CString(snapName)
 	defer C.free(unsafe.Pointer(snapNameC))
 
@@ -256,6 +472,16 @@ func (img *Image) UnProtectSnap(snapName string) error {
 
 // IsProtectedSnap finds out if a snapshot is protected.
 func (img *Image) IsProtectedSnap(snapName string) (bool, error) {
+	return img.IsProtectedSnapContext(context.Background(), snapName)
+}
+
+// IsProtectedSnapContext is IsProtectedSnap passing ctx to the observer.
+func (img *Image) IsProtectedSnapContext(ctx context.Context, snapName string) (_ bool, err error) {
+	defer img.observe(ctx, "is_protected_snap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return false, err
+	}
+	defer img.unlock()
 	snapNameC := C.CString(snapName)
 	defer C.free(unsafe.Pointer(snapNameC))
 	var isProtectedC C.int
@@ -266,8 +492,55 @@ func (img *Image) IsProtectedSnap(snapName string) (bool, error) {
 	return isProtectedC == 1, nil
 }
 
+// ListSnaps lists the snapshots of the image, ordered by creation.
+func (img *Image) ListSnaps() ([]SnapInfo, error) {
+	return img.ListSnapsContext(context.Background())
+}
+
+// ListSnapsContext is ListSnaps passing ctx to the observer.
+func (img *Image) ListSnapsContext(ctx context.Context) (_ []SnapInfo, err error) {
+	defer img.observe(ctx, "list_snaps", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return nil, err
+	}
+	defer img.unlock()
+	maxC := C.int(16)
+	var snapsC []C.rbd_snap_info_t
+	var retC C.int
+	for {
+		snapsC = make([]C.rbd_snap_info_t, int(maxC))
+		retC = C.rbd_snap_list(img.getC(), &snapsC[0], &maxC)
+		if retC != -C.ERANGE {
+			break
+		}
+	}
+	if retC < 0 {
+		return nil, &cError{fmt.Sprintf("Cannot list snapshots of image %s", img.name), 0, retC}
+	}
+	defer C.rbd_snap_list_end(&snapsC[0])
+	res := make([]SnapInfo, int(retC))
+	for i := range res {
+		res[i] = SnapInfo{
+			ID:   uint64(snapsC[i].id),
+			Size: uint64(snapsC[i].size),
+			Name: C.GoString(snapsC[i].name),
+		}
+	}
+	return res, nil
+}
+
 // SetSnap sets the snapshot to read from.
 func (img *Image) SetSnap(snapName string) error {
+	return img.SetSnapContext(context.Background(), snapName)
+}
+
+// SetSnapContext is SetSnap passing ctx to the observer.
+func (img *Image) SetSnapContext(ctx context.Context, snapName string) (err error) {
+	defer img.observe(ctx, "set_snap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	snapNameC := C.CString(snapName)
 	defer C.free(unsafe.Pointer(snapNameC))
 
@@ -280,6 +553,16 @@ func (img *Image) SetSnap(snapName string) error {
 
 // Overlap gets the number of overlapping bytes between the image and its parent.
 func (img *Image) Overlap() (uint64, error) {
+	return img.OverlapContext(context.Background())
+}
+
+// OverlapContext is Overlap passing ctx to the observer.
+func (img *Image) OverlapContext(ctx context.Context) (_ uint64, err error) {
+	defer img.observe(ctx, "overlap", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
 	var overlapC C.uint64_t
 	retC := C.rbd_get_overlap(img.getC(), &overlapC)
 	if retC != 0 {
@@ -290,6 +573,20 @@ func (img *Image) Overlap() (uint64, error) {
 
 // Copy the image to another location.
 func (img *Image) Copy(r *Rbd, dstName string) error {
+	return img.CopyContext(context.Background(), r, dstName)
+}
+
+// CopyContext is Copy passing ctx to the observer.
+func (img *Image) CopyContext(ctx context.Context, r *Rbd, dstName string) (err error) {
+	defer img.observe(ctx, "copy", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
 	dstNameC := C.CString(dstName)
 	defer C.free(unsafe.Pointer(dstNameC))
 	retC := C.rbd_copy(img.getC(), r.GetHandle(), dstNameC)
@@ -301,8 +598,18 @@ func (img *Image) Copy(r *Rbd, dstName string) error {
 
 // StripeUnit returns the stripe unit used for the image.
 func (img *Image) StripeUnit() (uint64, error) {
+	return img.StripeUnitContext(context.Background())
+}
+
+// StripeUnitContext is StripeUnit passing ctx to the observer.
+func (img *Image) StripeUnitContext(ctx context.Context) (_ uint64, err error) {
+	defer img.observe(ctx, "stripe_unit", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
 	var stripeUnitC C.uint64_t
-	retC := C.rbd_get_overlap(img.getC(), &stripeUnitC)
+	retC := C.rbd_get_stripe_unit(img.getC(), &stripeUnitC)
 	if retC != 0 {
 		return 0, &cError{fmt.Sprintf("Cannot get stripe unit for image %s", img.name), 0, retC}
 	}
@@ -311,8 +618,18 @@ func (img *Image) StripeUnit() (uint64, error) {
 
 // StripeCount returns the stripe count used for the image.
 func (img *Image) StripeCount() (uint64, error) {
+	return img.StripeCountContext(context.Background())
+}
+
+// StripeCountContext is StripeCount passing ctx to the observer.
+func (img *Image) StripeCountContext(ctx context.Context) (_ uint64, err error) {
+	defer img.observe(ctx, "stripe_count", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
 	var stripeCountC C.uint64_t
-	retC := C.rbd_get_overlap(img.getC(), &stripeCountC)
+	retC := C.rbd_get_stripe_count(img.getC(), &stripeCountC)
 	if retC != 0 {
 		return 0, &cError{fmt.Sprintf("Cannot get stripe count for image %s", img.name), 0, retC}
 	}
@@ -321,6 +638,16 @@ func (img *Image) StripeCount() (uint64, error) {
 
 // Flatten copies all blocks from the parent to the child.
 func (img *Image) Flatten() error {
+	return img.FlattenContext(context.Background())
+}
+
+// FlattenContext is Flatten passing ctx to the observer.
+func (img *Image) FlattenContext(ctx context.Context) (err error) {
+	defer img.observe(ctx, "flatten", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	retC := C.rbd_flatten(img.getC())
 	if retC != 0 {
 		return &cError{fmt.Sprintf("Cannot flatten image %s", img.name), 0, retC}
@@ -330,6 +657,11 @@ func (img *Image) Flatten() error {
 
 // Read implements the Reader interface.
 func (img *Image) Read(p []byte) (n int, err error) {
+	defer img.observeIO(context.Background(), "read", 0, len(p), time.Now(), &n, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
 	size := len(p)
 	lenC := C.size_t(size)
 	bufC := (*C.char)(unsafe.Pointer(&p[0]))
@@ -355,43 +687,98 @@ func (img *Image) Read(p []byte) (n int, err error) {
 	return n, fmt.Errorf("Too many bytes red, expected %d, got %d", len(p), len(p)-size)
 }
 
-// ReadRaw reads data from the image.
+// ReadRaw reads length bytes at offset from the image.  The bytes past
+// the end of the image are left zero.
+//
+// Deprecated: use ReadRawInto, which reads into a buffer of the caller.
 func (img *Image) ReadRaw(offset, length uint) (data string, err error) {
-	lenC := C.size_t(length)
+	if length == 0 {
+		return "", nil
+	}
 	buf := make([]byte, length)
-	bufC := (*C.char)(unsafe.Pointer(&buf[0]))
-	offsetC := C.uint64_t(offset)
-	retC := C.rbd_read(img.getC(), offsetC, lenC, bufC)
+	if _, err = img.ReadRawInto(buf, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+	// buf is not referenced anymore, it can back the string.
+	return unsafe.String(&buf[0], len(buf)), err
+}
+
+// ReadRawInto reads up to len(p) bytes at offset from the image into p,
+// passing p to librbd without copying it.  Like rbd_read, it returns
+// fewer bytes at the end of the image, and io.EOF past it.
+func (img *Image) ReadRawInto(p []byte, offset uint) (int, error) {
+	return img.ReadRawIntoContext(context.Background(), p, offset)
+}
+
+// ReadRawIntoContext is ReadRawInto passing ctx to the observer.
+func (img *Image) ReadRawIntoContext(ctx context.Context, p []byte, offset uint) (n int, err error) {
+	defer img.observeIO(ctx, "read", int64(offset), len(p), time.Now(), &n, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	retC := C.rbd_read(img.getC(), C.uint64_t(offset), C.size_t(len(p)), (*C.char)(unsafe.Pointer(&p[0])))
 	if retC == -C.EINVAL {
-		return string(buf), io.EOF
+		return 0, io.EOF
 	}
 	if retC < 0 {
-		return "", &cError{fmt.Sprintf("Cannot read from %d+%d in image %s (%v)", offset, length, img.name, retC), 0, (C.int)(retC)}
+		return 0, &cError{fmt.Sprintf("Cannot read from %d+%d in image %s (%v)", offset, len(p), img.name, retC), 0, (C.int)(retC)}
 	}
-	return string(buf), nil
+	return int(retC), nil
 }
 
-// WriteRaw reads data from the image.
+// WriteRaw writes data at offset in the image.  It returns -1 on error,
+// and io.EOF if data was only partially written.
+//
+// Deprecated: use WriteRawFrom, which takes a []byte.
 func (img *Image) WriteRaw(data string, offset uint) (n int, err error) {
-	length := len(data)
-	lenC := C.size_t(length)
-	offsetC := C.uint64_t(offset)
-	bufC := C.CString(data)
-	defer C.free(unsafe.Pointer(bufC))
-
-	retC := C.rbd_write(img.getC(), offsetC, lenC, bufC)
-	if int(retC) == length {
-		return length, nil
-	} else if retC < 0 {
-		return -1, &cError{fmt.Sprintf("Cannot write from %d in image %s (%v)", offset, img.name, retC), 0, (C.int)(retC)}
-	} else if int(retC) < length {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	// librbd does not modify the data, it can be read from the string.
+	n, err = img.WriteRawFrom(unsafe.Slice(unsafe.StringData(data), len(data)), offset)
+	if err != nil && err != io.EOF {
+		return -1, err
+	}
+	return n, err
+}
+
+// WriteRawFrom writes p at offset in the image, passing p to librbd
+// without copying it.  It returns io.EOF if p was only partially written.
+func (img *Image) WriteRawFrom(p []byte, offset uint) (int, error) {
+	return img.WriteRawFromContext(context.Background(), p, offset)
+}
+
+// WriteRawFromContext is WriteRawFrom passing ctx to the observer.
+func (img *Image) WriteRawFromContext(ctx context.Context, p []byte, offset uint) (n int, err error) {
+	defer img.observeIO(ctx, "write", int64(offset), len(p), time.Now(), &n, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	retC := C.rbd_write(img.getC(), C.uint64_t(offset), C.size_t(len(p)), (*C.char)(unsafe.Pointer(&p[0])))
+	if retC < 0 {
+		return 0, &cError{fmt.Sprintf("Cannot write from %d in image %s (%v)", offset, img.name, retC), 0, (C.int)(retC)}
+	}
+	if int(retC) < len(p) {
 		return int(retC), io.EOF
 	}
-	return int(retC), fmt.Errorf("Wrote more than expected!")
+	return int(retC), nil
 }
 
 // Write implements the writer interface.
 func (img *Image) Write(p []byte) (n int, err error) {
+	defer img.observeIO(context.Background(), "write", 0, len(p), time.Now(), &n, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
 	size := len(p)
 	lenC := C.size_t(size)
 	bufC := (*C.char)(unsafe.Pointer(&p[0]))
@@ -421,35 +808,131 @@ func (img *Image) Write(p []byte) (n int, err error) {
 	return n, fmt.Errorf("More bytes written %d than expected %d", n, size)
 }
 
+// ReadAt implements the ReaderAt interface.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	return img.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is ReadAt passing ctx to the observer.
+func (img *Image) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	defer img.observeIO(ctx, "read", off, len(p), time.Now(), &n, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	retC := C.rbd_read(img.getC(), C.uint64_t(off), C.size_t(len(p)), (*C.char)(unsafe.Pointer(&p[0])))
+	if retC == -C.EINVAL {
+		return 0, io.EOF
+	}
+	if retC < 0 {
+		return 0, &cError{fmt.Sprintf("Cannot read from %d+%d in image %s", off, len(p), img.name), 0, (C.int)(retC)}
+	}
+	if int(retC) < len(p) {
+		return int(retC), io.EOF
+	}
+	return int(retC), nil
+}
+
+// WriteAt implements the WriterAt interface.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	return img.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext is WriteAt passing ctx to the observer.
+func (img *Image) WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	defer img.observeIO(ctx, "write", off, len(p), time.Now(), &n, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	retC := C.rbd_write(img.getC(), C.uint64_t(off), C.size_t(len(p)), (*C.char)(unsafe.Pointer(&p[0])))
+	if retC == -C.EINVAL {
+		return 0, io.EOF
+	}
+	if retC < 0 {
+		return 0, &cError{fmt.Sprintf("Cannot write to %d+%d in image %s", off, len(p), img.name), 0, (C.int)(retC)}
+	}
+	if int(retC) < len(p) {
+		return int(retC), io.EOF
+	}
+	return int(retC), nil
+}
+
 // Discard the range from the image.
 func (img *Image) Discard(offset int, length int) error {
+	return img.DiscardContext(context.Background(), offset, length)
+}
+
+// DiscardContext is Discard passing ctx to the observer.
+func (img *Image) DiscardContext(ctx context.Context, offset int, length int) (err error) {
+	defer img.observeIO(ctx, "discard", int64(offset), length, time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	retC := C.rbd_discard(img.getC(), C.uint64_t(offset), C.uint64_t(length))
 	if retC < 0 {
-		return fmt.Errorf("Cannot discard region %d~%d from image %s", offset, length, img.name)
+		return &cError{fmt.Sprintf("Cannot discard region %d~%d from image %s", offset, length, img.name), 0, retC}
 	}
 	return nil
 }
 
 // Flush blocks until all writes are fully flushed if caching is enabled.
 func (img *Image) Flush() error {
+	return img.FlushContext(context.Background())
+}
+
+// FlushContext is Flush passing ctx to the observer.
+func (img *Image) FlushContext(ctx context.Context) (err error) {
+	defer img.observe(ctx, "flush", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	retC := C.rbd_flush(img.getC())
 	if retC < 0 {
-		return fmt.Errorf("Cannot flush image %s", img.name)
+		return &cError{fmt.Sprintf("Cannot flush image %s", img.name), 0, retC}
 	}
 	return nil
 }
 
 // InvalidateCache drop any cached data.
 func (img *Image) InvalidateCache() error {
+	return img.InvalidateCacheContext(context.Background())
+}
+
+// InvalidateCacheContext is InvalidateCache passing ctx to the observer.
+func (img *Image) InvalidateCacheContext(ctx context.Context) (err error) {
+	defer img.observe(ctx, "invalidate_cache", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	retC := C.rbd_invalidate_cache(img.getC())
 	if retC < 0 {
-		return fmt.Errorf("Cannot invalidate cache from image %s", img.name)
+		return &cError{fmt.Sprintf("Cannot invalidate cache from image %s", img.name), 0, retC}
 	}
 	return nil
 }
 
 // ListChildren lists children of the currently set snapshot.
 func (img *Image) ListChildren() ([]map[string]string, error) {
+	return img.ListChildrenContext(context.Background())
+}
+
+// ListChildrenContext is ListChildren passing ctx to the observer.
+func (img *Image) ListChildrenContext(ctx context.Context) (_ []map[string]string, err error) {
+	defer img.observe(ctx, "list_children", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return nil, err
+	}
+	defer img.unlock()
 
 	poolsSize := C.size_t(512)
 	imagesSize := C.size_t(512)
@@ -486,6 +969,16 @@ func (img *Image) ListChildren() ([]map[string]string, error) {
 
 // ListLockers list clients that have locked the image.
 func (img *Image) ListLockers() (Locker, error) {
+	return img.ListLockersContext(context.Background())
+}
+
+// ListLockersContext is ListLockers passing ctx to the observer.
+func (img *Image) ListLockersContext(ctx context.Context) (_ Locker, err error) {
+	defer img.observe(ctx, "list_lockers", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return Locker{}, err
+	}
+	defer img.unlock()
 	clientsSize := C.size_t(512)
 	cookiesSize := C.size_t(512)
 	addrsSize := C.size_t(512)
@@ -542,6 +1035,16 @@ func (img *Image) ListLockers() (Locker, error) {
 
 // LockExclusive takes an exclusive lock on the image.
 func (img *Image) LockExclusive(cookie string) error {
+	return img.LockExclusiveContext(context.Background(), cookie)
+}
+
+// LockExclusiveContext is LockExclusive passing ctx to the observer.
+func (img *Image) LockExclusiveContext(ctx context.Context, cookie string) (err error) {
+	defer img.observe(ctx, "lock_exclusive", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	cookieC := C.CString(cookie)
 	defer C.free(unsafe.Pointer(cookieC))
 	retC := C.rbd_lock_exclusive(img.getC(), cookieC)
@@ -553,6 +1056,16 @@ func (img *Image) LockExclusive(cookie string) error {
 
 // LockShared takes a shared lock on the image.
 func (img *Image) LockShared(cookie string, tag string) error {
+	return img.LockSharedContext(context.Background(), cookie, tag)
+}
+
+// LockSharedContext is LockShared passing ctx to the observer.
+func (img *Image) LockSharedContext(ctx context.Context, cookie string, tag string) (err error) {
+	defer img.observe(ctx, "lock_shared", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	cookieC := C.CString(cookie)
 	defer C.free(unsafe.Pointer(cookieC))
 	tagC := C.CString(tag)
@@ -566,6 +1079,16 @@ func (img *Image) LockShared(cookie string, tag string) error {
 
 // Unlock releases a lock on the image that was locked by this rados client.
 func (img *Image) Unlock(cookie string) error {
+	return img.UnlockContext(context.Background(), cookie)
+}
+
+// UnlockContext is Unlock passing ctx to the observer.
+func (img *Image) UnlockContext(ctx context.Context, cookie string) (err error) {
+	defer img.observe(ctx, "unlock", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	cookieC := C.CString(cookie)
 	defer C.free(unsafe.Pointer(cookieC))
 	retC := C.rbd_unlock(img.getC(), cookieC)
@@ -577,6 +1100,16 @@ func (img *Image) Unlock(cookie string) error {
 
 // BreakLock releases a lock held by another rados client.
 func (img *Image) BreakLock(client string, cookie string) error {
+	return img.BreakLockContext(context.Background(), client, cookie)
+}
+
+// BreakLockContext is BreakLock passing ctx to the observer.
+func (img *Image) BreakLockContext(ctx context.Context, client string, cookie string) (err error) {
+	defer img.observe(ctx, "break_lock", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
 	cookieC := C.CString(cookie)
 	defer C.free(unsafe.Pointer(cookieC))
 	clientC := C.CString(client)
@@ -588,6 +1121,21 @@ func (img *Image) BreakLock(client string, cookie string) error {
 	return nil
 }
 
+// Tag returns the tag shared by the lockers.
+func (l Locker) Tag() string {
+	return l.tag
+}
+
+// Exclusive tells whether the lock is exclusive.
+func (l Locker) Exclusive() bool {
+	return l.exclusive
+}
+
+// Lockers returns the client, cookie and address of each locker.
+func (l Locker) Lockers() [][]string {
+	return l.lockers
+}
+
 // String implements the stringer interface for Locker.
 func (l Locker) String() (str string) {
 	str = fmt.Sprintf("Locker{tag: %s, exclusive: %v, lockers: %v",
@@ -600,34 +1148,140 @@ func (l Locker) String() (str string) {
 // DiffHandler is the signature of the callback passed to DiffIterate.
 type DiffHandler func(offset, length, exists int, d interface{}) int
 
-type diffHandlerPasser struct {
-	f DiffHandler
-	d interface{}
+// Extent is a range of an image reported by DiffIterate2.
+type Extent struct {
+	Offset uint64
+	Length uint64
+	Exists bool
+}
+
+// diffIterator is the state shared with goDiffCB through a cgo.Handle.
+type diffIterator struct {
+	ctx context.Context
+	f   func(Extent) error
+	err error
 }
 
 //export goDiffCB
 func goDiffCB(offset C.uint64_t, length C.size_t, exists C.int, userdata unsafe.Pointer) C.int {
-	req := (*diffHandlerPasser)(userdata)
-	return C.int(req.f(int(offset), int(length), int(exists), req.d))
+	it := cgo.Handle(uintptr(userdata)).Value().(*diffIterator)
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return -C.ECANCELED
+	}
+	if err := it.f(Extent{uint64(offset), uint64(length), exists != 0}); err != nil {
+		it.err = err
+		return -C.ECANCELED
+	}
+	return 0
 }
 
 // DiffIterate iterates over the changed extents of an image.
 //
-// See https://stackoverflow.com/questions/6125683/call-go-functions-from-c for
-// more information on the c plumbing necessary to make this works.
+// Deprecated: use DiffIterate2 which is cancellable and reports typed
+// extents.
 func (img *Image) DiffIterate(offset int, length int, fromSnapshot string, f DiffHandler, d interface{}) error {
-	fromSnapshotC := C.CString(fromSnapshot)
-	defer C.free(unsafe.Pointer(fromSnapshotC))
-	req := unsafe.Pointer(&diffHandlerPasser{f, d})
-	retC := C.goDiffIter(
+	legacy := func(e Extent) error {
+		exists := 0
+		if e.Exists {
+			exists = 1
+		}
+		if ret := f(int(e.Offset), int(e.Length), exists, d); ret < 0 {
+			return &cError{"Diff callback failed", 0, C.int(ret)}
+		}
+		return nil
+	}
+	return img.DiffIterate2(context.Background(), fromSnapshot, uint64(offset), uint64(length), true, false, legacy)
+}
+
+// DiffIterate2 calls f for each extent of the image that changed since
+// fromSnapshot, or for each allocated extent if fromSnapshot is empty.
+// With wholeObject the object map is used, if available, and whole
+// objects are reported.  Iteration stops at the first error returned by
+// f or when ctx is done, and that error is returned.  The extents are
+// collected before f is called, so f may use the image, and Close does
+// not wait for the iteration.
+func (img *Image) DiffIterate2(ctx context.Context, fromSnapshot string, offset uint64, length uint64, includeParent bool, wholeObject bool, f func(Extent) error) (err error) {
+	defer img.observeIO(ctx, "diff_iterate", int64(offset), int(length), time.Now(), nil, &err)
+	var extents []Extent
+	collect := func(e Extent) error {
+		extents = append(extents, e)
+		return nil
+	}
+	if err := img.diffIterate(ctx, fromSnapshot, offset, length, includeParent, wholeObject, collect); err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffIterate is DiffIterate2 calling f from the librbd callback, with
+// img locked.  f must not use img.
+func (img *Image) diffIterate(ctx context.Context, fromSnapshot string, offset uint64, length uint64, includeParent bool, wholeObject bool, f func(Extent) error) error {
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	var fromSnapshotC *C.char
+	if fromSnapshot != "" {
+		fromSnapshotC = C.CString(fromSnapshot)
+		defer C.free(unsafe.Pointer(fromSnapshotC))
+	}
+	includeParentC := C.uint8_t(0)
+	if includeParent {
+		includeParentC = 1
+	}
+	wholeObjectC := C.uint8_t(0)
+	if wholeObject {
+		wholeObjectC = 1
+	}
+	it := &diffIterator{ctx: ctx, f: f}
+	handle := cgo.NewHandle(it)
+	defer handle.Delete()
+
+	retC := C.goDiffIter2(
 		img.getC(),
 		fromSnapshotC,
 		C.uint64_t(offset),
 		C.uint64_t(length),
-		req,
+		includeParentC,
+		wholeObjectC,
+		C.uintptr_t(handle),
 	)
+	if it.err != nil {
+		return it.err
+	}
 	if retC < 0 {
-		return &cError{fmt.Sprintf("Cannot generate diff from snapshot %s", fromSnapshot), 0, retC}
+		return &cError{fmt.Sprintf("Cannot generate diff of image %s from snapshot %s", img.name, fromSnapshot), 0, retC}
 	}
 	return nil
 }
+
+// ChangedExtents returns the extents reported by DiffIterate2, merging
+// the adjacent ones.
+func (img *Image) ChangedExtents(ctx context.Context, fromSnapshot string, offset uint64, length uint64, includeParent bool, wholeObject bool) (_ []Extent, err error) {
+	defer img.observeIO(ctx, "diff_iterate", int64(offset), int(length), time.Now(), nil, &err)
+	var extents []Extent
+	collect := func(e Extent) error {
+		if n := len(extents); n > 0 {
+			last := &extents[n-1]
+			if last.Exists == e.Exists && last.Offset+last.Length == e.Offset {
+				last.Length += e.Length
+				return nil
+			}
+		}
+		extents = append(extents, e)
+		return nil
+	}
+	if err := img.diffIterate(ctx, fromSnapshot, offset, length, includeParent, wholeObject, collect); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
@@ -2,9 +2,18 @@ package rbd
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func createDevice(rbdTest *rbdTest, prefix string, size uint64, count uint, options ...func(*Config) error) string {
@@ -29,6 +38,33 @@ func Test_OpenClose(t *testing.T) {
 	checkError(t, err, "Problem closing the image %s (features failed)", device)
 }
 
+func Test_UseAfterClose(t *testing.T) {
+	img, rbdTest := getImage(t, "use_after_close")
+	defer rbdTest.r.Remove(img.name)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for {
+				if _, err := img.ReadAt(buf, 0); err == ErrClosed {
+					return
+				} else if err != nil {
+					t.Errorf("Cannot read from %s: %v", img.name, err)
+					return
+				}
+			}
+		}()
+	}
+	checkError(t, img.Close(), "Problem closing the image %s", img.name)
+	wg.Wait()
+	checkError(t, img.Close(), "Problem closing the image %s twice", img.name)
+	if _, err := img.Size(); err != ErrClosed {
+		t.Errorf("Wrong error using the closed image %s, expected %v, got %v", img.name, ErrClosed, err)
+	}
+}
+
 func Test_stat(t *testing.T) {
 	rbdTest := setupContext(t, "image_test", 1)
 	size := uint64(5)
@@ -54,14 +90,14 @@ func checkSize(t *testing.T, img *Image, size uint64) {
 	}
 }
 
-func getImage(t *testing.T, name string, options ...func(*Config) error) (img *Image, rbdTest *rbdTest) {
+func getImage(t testing.TB, name string, options ...func(*Config) error) (img *Image, rbdTest *rbdTest) {
 	fMb := 5 * 1024 * 1024
 	size := uint64(fMb)
 	return getImageSized(t, name, size, options...)
 
 }
 
-func getImageSized(t *testing.T, name string, size uint64, options ...func(*Config) error) (img *Image, rbdTest *rbdTest) {
+func getImageSized(t testing.TB, name string, size uint64, options ...func(*Config) error) (img *Image, rbdTest *rbdTest) {
 	rbdTest = setupContext(t, "image_test", 2)
 	device := createDevice(rbdTest, name, size, 0, options...)
 	img, _ = NewImage(rbdTest.r, device)
@@ -373,3 +409,905 @@ func Test_DiffIter(t *testing.T) {
 		}
 	}
 }
+
+func Test_Encryption(t *testing.T) {
+	img, rbdTest := getImageSized(t, "encryption", 64*1024*1024, Layering())
+	defer endImage(rbdTest, img)
+	passphrase := []byte("test_passphrase")
+	if err := img.EncryptionFormat(EncryptionFormatLUKS2, passphrase, AES128()); err != nil {
+		t.Fatalf("Cannot format encryption of %s: %v", img.name, err)
+	}
+	// the handle used to format is already encrypted
+	buf := []byte("test_encryption")
+	if _, err := img.WriteAt(buf, 0); err != nil {
+		t.Errorf("Problem writing to %s: %v", img.name, err)
+	}
+
+	reopened, err := NewImage(rbdTest.r, img.name)
+	checkFatal(t, err, "Problem opening the image %s", img.name)
+	defer reopened.Close()
+	if err := reopened.EncryptionLoad(EncryptionFormatLUKS, passphrase); err != nil {
+		t.Fatalf("Cannot load encryption of %s: %v", img.name, err)
+	}
+	readBuf := make([]byte, len(buf))
+	if _, err := reopened.ReadAt(readBuf, 0); err != nil && err != io.EOF {
+		t.Errorf("Problem reading from %s: %v", img.name, err)
+	}
+	if !bytes.Equal(buf, readBuf) {
+		t.Errorf("Wrong decrypted data from %s, expected %s, got %s", img.name, buf, readBuf)
+	}
+
+	raw, err := NewImage(rbdTest.r, img.name)
+	checkFatal(t, err, "Problem opening the image %s", img.name)
+	defer raw.Close()
+	if err := raw.EncryptionLoad(EncryptionFormatLUKS2, []byte("wrong")); err == nil {
+		t.Errorf("Encryption of %s loaded with a wrong passphrase", img.name)
+	}
+}
+
+func Test_EncryptionClone(t *testing.T) {
+	parent, rbdTest := getImageSized(t, "encryption_parent", 64*1024*1024, Layering())
+	defer endImage(rbdTest, parent)
+	parentPassphrase := []byte("parent_passphrase")
+	checkFatal(t, parent.EncryptionFormat(EncryptionFormatLUKS2, parentPassphrase), "Cannot format encryption of %s", parent.name)
+	buf := []byte("parent_data")
+	_, err := parent.WriteAt(buf, 4096)
+	checkFatal(t, err, "Problem writing to %s", parent.name)
+	checkFatal(t, parent.CreateSnap("encrypted"), "Cannot snap %s", parent.name)
+	defer parent.RemoveSnap("encrypted")
+	checkFatal(t, parent.ProtectSnap("encrypted"), "Cannot protect snap of %s", parent.name)
+	defer parent.UnProtectSnap("encrypted")
+
+	childName := parent.name + "_child"
+	checkFatal(t, rbdTest.r.Clone(parent.name, "encrypted", rbdTest.r, childName, Layering()), "Cannot clone %s", parent.name)
+	defer rbdTest.r.Remove(childName)
+	child, err := NewImage(rbdTest.r, childName)
+	checkFatal(t, err, "Problem opening the image %s", childName)
+	childPassphrase := []byte("child_passphrase")
+	err = child.EncryptionFormat(EncryptionFormatLUKS2, childPassphrase)
+	child.Close()
+	checkFatal(t, err, "Cannot format encryption of %s", childName)
+
+	child, err = NewImage(rbdTest.r, childName)
+	checkFatal(t, err, "Problem opening the image %s", childName)
+	defer child.Close()
+	err = child.EncryptionLoad(EncryptionFormatLUKS, childPassphrase, EncryptionSpec{EncryptionFormatLUKS, parentPassphrase})
+	checkFatal(t, err, "Cannot load encryption of %s", childName)
+	readBuf := make([]byte, len(buf))
+	if _, err := child.ReadAt(readBuf, 4096); err != nil {
+		t.Errorf("Problem reading from %s: %v", childName, err)
+	}
+	if !bytes.Equal(buf, readBuf) {
+		t.Errorf("Wrong parent data read through %s, expected %s, got %s", childName, buf, readBuf)
+	}
+}
+
+func findConfig(options []ConfigOption, name string) (ConfigOption, bool) {
+	for _, o := range options {
+		if o.Name == name {
+			return o, true
+		}
+	}
+	return ConfigOption{}, false
+}
+
+func Test_Config(t *testing.T) {
+	img, rbdTest := getImage(t, "config", Layering())
+	defer endImage(rbdTest, img)
+	if err := img.SetConfig("rbd_qos_iops_limit", "100"); err != nil {
+		t.Fatalf("Cannot set configuration of %s: %v", img.name, err)
+	}
+	options, err := img.ConfigList()
+	checkFatal(t, err, "Cannot list configuration of %s", img.name)
+	o, ok := findConfig(options, "rbd_qos_iops_limit")
+	if !ok || o.Value != "100" || o.Source != ConfigSourceImage {
+		t.Errorf("Wrong configuration for %s, got %v", img.name, o)
+	}
+	if err := img.RemoveConfig("rbd_qos_iops_limit"); err != nil {
+		t.Errorf("Cannot remove configuration of %s: %v", img.name, err)
+	}
+	options, err = img.ConfigList()
+	checkFatal(t, err, "Cannot list configuration of %s", img.name)
+	if o, _ := findConfig(options, "rbd_qos_iops_limit"); o.Source == ConfigSourceImage {
+		t.Errorf("Configuration still overridden for %s, got %v", img.name, o)
+	}
+}
+
+func Test_DiskUsage(t *testing.T) {
+	img, rbdTest := getImageSized(t, "disk_usage", 8*1024*1024, Layering())
+	defer endImage(rbdTest, img)
+	if _, err := img.WriteRaw("test_disk_usage", 0); err != nil {
+		t.Fatalf("Problem writing to %s: %v", img.name, err)
+	}
+	if err := img.CreateSnap("snap_001"); err != nil {
+		t.Fatalf("Cannot snap %s", img.name)
+	}
+	defer img.RemoveSnap("snap_001")
+	snaps, err := img.ListSnaps()
+	checkFatal(t, err, "Cannot list snapshots of %s", img.name)
+	if len(snaps) != 1 || snaps[0].Name != "snap_001" {
+		t.Errorf("Wrong snapshots for %s, got %v", img.name, snaps)
+	}
+	used, err := img.DiskUsage("")
+	checkError(t, err, "Cannot get disk usage of %s", img.name)
+	if used == 0 {
+		t.Errorf("Disk usage of %s should not be 0", img.name)
+	}
+	used, err = img.DiskUsage("snap_001")
+	checkError(t, err, "Cannot get disk usage of %s since snap_001", img.name)
+	if used != 0 {
+		t.Errorf("Disk usage of %s since snap_001 should be 0, got %d", img.name, used)
+	}
+
+	usages, err := rbdTest.r.DiskUsage(2)
+	checkFatal(t, err, "Cannot get disk usage of pool %s", rbdTest.poolName)
+	var found int
+	for _, u := range usages {
+		if u.Name == img.name {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("Expected usage of %s and its snapshot, got %v", img.name, usages)
+	}
+
+	stats, err := rbdTest.r.PoolStats()
+	checkError(t, err, "Cannot get stats of pool %s", rbdTest.poolName)
+	if stats.Images == 0 || stats.ImageSnapshots == 0 {
+		t.Errorf("Wrong stats for pool %s, got %+v", rbdTest.poolName, stats)
+	}
+}
+
+func Test_ChangedExtents(t *testing.T) {
+	img, rbdTest := getImageSized(t, "changed_extents", 13, Layering(), Stripingv2())
+	defer endImage(rbdTest, img)
+	img.Write([]byte("test_writing"))
+	if err := img.CreateSnap("snap_001"); err != nil {
+		t.Fatalf("Cannot snap %s", img.name)
+	}
+	// off 4, len 2 and off 6, len 1 are adjacent
+	img.WriteRaw("Ab", 4)
+	img.WriteRaw("c", 6)
+	img.WriteRaw("A", 12)
+
+	extents, err := img.ChangedExtents(context.Background(), "snap_001", 0, 13, false, false)
+	checkFatal(t, err, "Cannot get changed extents of %s", img.name)
+	expected := []Extent{
+		{4, 3, true},
+		{12, 1, true},
+	}
+	if len(extents) != len(expected) {
+		t.Fatalf("Wrong number of extents, got %v expected %v", extents, expected)
+	}
+	for i := range expected {
+		if extents[i] != expected[i] {
+			t.Errorf("Wrong extent, got %v expected %v", extents[i], expected[i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = img.DiffIterate2(ctx, "snap_001", 0, 13, false, false, func(Extent) error { return nil })
+	if err != context.Canceled {
+		t.Errorf("Diff iteration of %s should have been canceled, got %v", img.name, err)
+	}
+}
+
+func Test_DiffIterate2Reentrant(t *testing.T) {
+	img, rbdTest := getImageSized(t, "diff_reentrant", 13, Layering())
+	defer endImage(rbdTest, img)
+	img.WriteRaw("test_writing", 0)
+
+	calls := 0
+	err := img.DiffIterate2(context.Background(), "", 0, 13, false, false, func(e Extent) error {
+		calls++
+		if calls > 1 {
+			return nil
+		}
+		buf := make([]byte, e.Length)
+		if _, err := img.ReadAt(buf, int64(e.Offset)); err != nil {
+			t.Errorf("Cannot read %s from the diff callback: %v", img.name, err)
+		}
+		// Close must not wait for the callback, nor the callback for Close
+		closed := make(chan error, 1)
+		go func() { closed <- img.Close() }()
+		select {
+		case err := <-closed:
+			checkError(t, err, "Problem closing the image %s", img.name)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Closing %s from the diff callback deadlocked", img.name)
+		}
+		if _, err := img.ReadAt(buf, int64(e.Offset)); err != ErrClosed {
+			t.Errorf("Wrong error reading the closed image %s, expected %v, got %v", img.name, ErrClosed, err)
+		}
+		return nil
+	})
+	checkError(t, err, "Cannot iterate over the diff of %s", img.name)
+	if calls == 0 {
+		t.Errorf("No extent of %s reported", img.name)
+	}
+}
+
+func Test_CopySparse(t *testing.T) {
+	size := uint64(16 * 1024 * 1024)
+	src, rbdTest := getImageSized(t, "copy_sparse_src", size, Layering())
+	defer endImage(rbdTest, src)
+	dst, rbdTest2 := getImageSized(t, "copy_sparse_dst", 1, Layering())
+	defer endImage(rbdTest2, dst)
+	buf := []byte("test_copy_sparse")
+	src.WriteAt(buf, 0)
+	src.WriteAt(buf, int64(size)-int64(len(buf)))
+
+	n, err := CopySparse(dst, src)
+	checkFatal(t, err, "Cannot copy %s to %s", src.name, dst.name)
+	if n > 2*copyChunkSize {
+		t.Errorf("Too many bytes written to %s: %d", dst.name, n)
+	}
+	checkSize(t, dst, size)
+	readBuf := make([]byte, len(buf))
+	dst.ReadAt(readBuf, int64(size)-int64(len(buf)))
+	if !bytes.Equal(buf, readBuf) {
+		t.Errorf("Wrong data copied to %s, expected %s, got %s", dst.name, buf, readBuf)
+	}
+
+	f, err := ioutil.TempFile("", "copy_sparse")
+	checkFatal(t, err, "Cannot create temporary file")
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := CopySparseToFile(f, src); err != nil {
+		t.Fatalf("Cannot copy %s to %s: %v", src.name, f.Name(), err)
+	}
+	fileImg, rbdTest3 := getImageSized(t, "copy_sparse_file", 1, Layering())
+	defer endImage(rbdTest3, fileImg)
+	if _, err := CopySparseFromFile(fileImg, f); err != nil {
+		t.Fatalf("Cannot copy %s to %s: %v", f.Name(), fileImg.name, err)
+	}
+	checkSize(t, fileImg, size)
+	fileImg.ReadAt(readBuf, 0)
+	if !bytes.Equal(buf, readBuf) {
+		t.Errorf("Wrong data copied to %s, expected %s, got %s", fileImg.name, buf, readBuf)
+	}
+}
+
+func Test_Metadata(t *testing.T) {
+	img, rbdTest := getImage(t, "metadata", Layering())
+	defer endImage(rbdTest, img)
+	if err := img.SetMetadata("schedule", "hourly"); err != nil {
+		t.Fatalf("Cannot set metadata of %s: %v", img.name, err)
+	}
+	value, err := img.GetMetadata("schedule")
+	checkFatal(t, err, "Cannot get metadata of %s", img.name)
+	if value != "hourly" {
+		t.Errorf("Wrong metadata for %s, expected hourly, got %s", img.name, value)
+	}
+	if err := img.RemoveMetadata("schedule"); err != nil {
+		t.Errorf("Cannot remove metadata of %s: %v", img.name, err)
+	}
+	_, err = img.GetMetadata("schedule")
+	if errno, _ := Errno(err); errno != syscall.ENOENT {
+		t.Errorf("Metadata still present for %s: %v", img.name, err)
+	}
+}
+
+func Test_ObjectMap(t *testing.T) {
+	rbdTest := setupContext(t, "image_test", 0)
+	device := createDevice(rbdTest, "object_map", 16*1024*1024, 0, Layering())
+	defer rbdTest.r.Remove(device)
+	_, err := rbdCmd(t, "-p", rbdTest.poolName, "feature", "enable", device, "exclusive-lock", "object-map", "fast-diff")
+	checkFatal(t, err, "Cannot enable object map on %s", device)
+	img, err := NewImage(rbdTest.r, device)
+	checkFatal(t, err, "Cannot open %s", device)
+	defer img.Close()
+	_, err = img.WriteAt([]byte("object map"), 5*1024*1024)
+	checkFatal(t, err, "Cannot write to %s", device)
+	checkFatal(t, img.Flush(), "Cannot flush %s", device)
+
+	calls := 0
+	err = img.RebuildObjectMap(func(offset, total uint64) error {
+		calls++
+		return nil
+	})
+	checkFatal(t, err, "Cannot rebuild object map of %s", device)
+	if calls == 0 {
+		t.Errorf("Progress of the rebuild of %s not reported", device)
+	}
+	flags, err := img.Flags()
+	checkError(t, err, "Cannot get flags of %s", device)
+	if flags&(FlagObjectMapInvalid|FlagFastDiffInvalid) != 0 {
+		t.Errorf("Object map of %s still invalid: %#x", device, flags)
+	}
+	discrepancies, err := CheckObjectMap(context.Background(), rbdTest.r, img)
+	checkFatal(t, err, "Cannot check object map of %s", device)
+	if len(discrepancies) != 0 {
+		t.Errorf("Wrong object map for %s: %v", device, discrepancies)
+	}
+
+	// remove the written data object behind the back of the object map
+	info, err := img.Stat()
+	checkFatal(t, err, "Cannot stat %s", device)
+	prefix := strings.TrimRight(info["block_name_prefix"].(string), "\x00")
+	objectNo := uint64(5*1024*1024) / info["obj_size"].(uint64)
+	object := objectName(prefix, false, objectNo)
+	if out, err := exec.Command("/usr/bin/rados", "-p", rbdTest.poolName, "rm", object).CombinedOutput(); err != nil {
+		t.Fatalf("Cannot remove object %s of %s: %v: %s", object, device, err, out)
+	}
+	discrepancies, err = CheckObjectMap(context.Background(), rbdTest.r, img)
+	checkFatal(t, err, "Cannot check object map of %s", device)
+	expected := ObjectMapDiscrepancy{objectNo, object, true, false}
+	if len(discrepancies) != 1 || discrepancies[0] != expected {
+		t.Errorf("Wrong discrepancies for %s, expected [%v], got %v", device, expected, discrepancies)
+	}
+
+	// without fast-diff the diff does not reflect the object map
+	noFastDiff := createDevice(rbdTest, "object_map_no_fast_diff", 16*1024*1024, 1, Layering())
+	defer rbdTest.r.Remove(noFastDiff)
+	_, err = rbdCmd(t, "-p", rbdTest.poolName, "feature", "enable", noFastDiff, "exclusive-lock", "object-map")
+	checkFatal(t, err, "Cannot enable object map on %s", noFastDiff)
+	img2, err := NewImage(rbdTest.r, noFastDiff)
+	checkFatal(t, err, "Cannot open %s", noFastDiff)
+	defer img2.Close()
+	if _, err := CheckObjectMap(context.Background(), rbdTest.r, img2); err == nil {
+		t.Errorf("Object map of %s checked without fast-diff", noFastDiff)
+	}
+}
+
+// allocated returns the number of bytes allocated to img.
+func allocated(t *testing.T, img *Image) uint64 {
+	size, err := img.Size()
+	checkFatal(t, err, "Cannot get size of %s", img.name)
+	extents, err := img.ChangedExtents(context.Background(), "", 0, size, false, false)
+	checkFatal(t, err, "Cannot list extents of %s", img.name)
+	var n uint64
+	for _, e := range extents {
+		if e.Exists {
+			n += e.Length
+		}
+	}
+	return n
+}
+
+func Test_Sparsify(t *testing.T) {
+	img, rbdTest := getImageSized(t, "sparsify", 16*1024*1024, Layering())
+	defer endImage(rbdTest, img)
+	for _, sparsify := range []func() error{
+		func() error { return img.Sparsify(64 * 1024) },
+		func() error { return img.sparsifyByDiscard(context.Background(), 64*1024, nil) },
+	} {
+		data := make([]byte, 8*1024*1024)
+		copy(data, "data")
+		_, err := img.WriteAt(data, 0)
+		checkFatal(t, err, "Cannot write to %s", img.name)
+		before := allocated(t, img)
+		checkFatal(t, sparsify(), "Cannot sparsify %s", img.name)
+		after := allocated(t, img)
+		if after >= before {
+			t.Errorf("Nothing reclaimed from %s: %d bytes allocated before, %d after", img.name, before, after)
+		}
+		readBuf := make([]byte, 4)
+		img.ReadAt(readBuf, 0)
+		if string(readBuf) != "data" {
+			t.Errorf("Data lost from %s, got %q", img.name, readBuf)
+		}
+	}
+	if err := img.Sparsify(1000); err == nil {
+		t.Errorf("Invalid sparse size accepted for %s", img.name)
+	}
+}
+
+func Test_WritePrimitives(t *testing.T) {
+	img, rbdTest := getImage(t, "write_primitives", Layering())
+	defer endImage(rbdTest, img)
+	checkFatal(t, img.WriteSame(0, 4096, []byte("abcd")), "Cannot write same to %s", img.name)
+	buf := make([]byte, 4096)
+	img.ReadAt(buf, 0)
+	if !bytes.Equal(buf, bytes.Repeat([]byte("abcd"), 1024)) {
+		t.Errorf("Wrong data written to %s: %q", img.name, buf[:16])
+	}
+	if err := img.WriteSame(0, 4095, []byte("abcd")); err == nil {
+		t.Errorf("Write same accepted a length not multiple of the pattern")
+	}
+
+	checkFatal(t, img.WriteZeroes(0, 2048, 0), "Cannot write zeroes to %s", img.name)
+	checkFatal(t, img.WriteZeroes(2048, 512, WriteZeroesThickProvision), "Cannot write zeroes to %s", img.name)
+	img.ReadAt(buf, 0)
+	if !isZero(buf[:2560]) || buf[2560] != 'a' {
+		t.Errorf("Wrong data zeroed in %s", img.name)
+	}
+
+	cmp := make([]byte, 512)
+	copy(cmp, buf[3072:3584])
+	newData := bytes.Repeat([]byte("z"), 512)
+	_, err := img.CompareAndWrite(3072, cmp, newData)
+	checkFatal(t, err, "Cannot compare and write to %s", img.name)
+	copy(cmp, newData)
+	cmp[10] = 'x'
+	mismatch, err := img.CompareAndWrite(3072, cmp, newData)
+	var mismatchErr *ErrMismatch
+	if !errors.As(err, &mismatchErr) || mismatch != 3082 || mismatchErr.Offset != mismatch {
+		t.Errorf("Wrong mismatch for %s, got offset %d: %v", img.name, mismatch, err)
+	}
+}
+
+func Test_VectoredIO(t *testing.T) {
+	img, rbdTest := getImage(t, "vectored_io", Layering())
+	defer endImage(rbdTest, img)
+	bufs := [][]byte{[]byte("scatter"), {}, []byte("-"), []byte("gather")}
+	n, err := img.WriteV(1000, bufs)
+	checkFatal(t, err, "Cannot write vector to %s", img.name)
+	if n != 14 {
+		t.Errorf("Wrong number of bytes written to %s, expected 14, got %d", img.name, n)
+	}
+	buf := make([]byte, 14)
+	img.ReadAt(buf, 1000)
+	if string(buf) != "scatter-gather" {
+		t.Errorf("Wrong data written to %s: %q", img.name, buf)
+	}
+
+	readBufs := [][]byte{make([]byte, 8), make([]byte, 6)}
+	cp, err := img.AioReadV(1000, readBufs)
+	checkFatal(t, err, "Cannot read vector from %s", img.name)
+	n, err = cp.Wait()
+	checkFatal(t, err, "Cannot read vector from %s", img.name)
+	if n != 14 || string(readBufs[0]) != "scatter-" || string(readBufs[1]) != "gather" {
+		t.Errorf("Wrong data read from %s: %d bytes, %q", img.name, n, readBufs)
+	}
+
+	size, _ := img.Size()
+	n, err = img.ReadV(size-4, [][]byte{make([]byte, 8)})
+	if err != io.EOF {
+		t.Errorf("Wrong error reading past the end of %s: %d bytes, %v", img.name, n, err)
+	}
+
+	// Close waits for the I/O in flight
+	cp, err = img.AioWriteV(1000, bufs)
+	checkFatal(t, err, "Cannot write vector to %s", img.name)
+	closed := make(chan error, 1)
+	go func() { closed <- img.Close() }()
+	select {
+	case <-closed:
+		t.Errorf("%s closed with an I/O in flight", img.name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = cp.Wait()
+	checkError(t, err, "Cannot write vector to %s", img.name)
+	checkError(t, <-closed, "Problem closing the image %s", img.name)
+}
+
+func Test_RawIOAllocs(t *testing.T) {
+	img, rbdTest := getImage(t, "raw_io_allocs", Layering())
+	defer endImage(rbdTest, img)
+	buf := make([]byte, 4096)
+	writes := testing.AllocsPerRun(100, func() {
+		if _, err := img.WriteRawFrom(buf, 0); err != nil {
+			t.Fatalf("Cannot write to %s: %v", img.name, err)
+		}
+	})
+	reads := testing.AllocsPerRun(100, func() {
+		if _, err := img.ReadRawInto(buf, 0); err != nil {
+			t.Fatalf("Cannot read from %s: %v", img.name, err)
+		}
+	})
+	if writes != 0 || reads != 0 {
+		t.Errorf("I/Os allocate: %v allocations per write, %v per read", writes, reads)
+	}
+}
+
+func Test_BufferPool(t *testing.T) {
+	pool := NewBufferPool(4096)
+	buf := pool.Get()
+	if len(*buf) != 4096 {
+		t.Errorf("Wrong buffer size, expected 4096, got %d", len(*buf))
+	}
+	*buf = (*buf)[:10]
+	pool.Put(buf)
+	if buf := pool.Get(); len(*buf) != 4096 {
+		t.Errorf("Wrong buffer size after reuse, expected 4096, got %d", len(*buf))
+	}
+	pool.Get()
+	allocs := testing.AllocsPerRun(100, func() {
+		pool.Put(pool.Get())
+	})
+	if allocs != 0 {
+		t.Errorf("Buffer pool allocates: %v allocations per buffer", allocs)
+	}
+}
+
+func benchmarkImage(b *testing.B, name string) (*Image, *rbdTest) {
+	img, rbdTest := getImage(b, name, Layering())
+	b.ReportAllocs()
+	b.SetBytes(4096)
+	b.ResetTimer()
+	return img, rbdTest
+}
+
+func Benchmark_ReadRaw(b *testing.B) {
+	img, rbdTest := benchmarkImage(b, "bench_read_raw")
+	defer endImage(rbdTest, img)
+	for i := 0; i < b.N; i++ {
+		img.ReadRaw(0, 4096)
+	}
+}
+
+func Benchmark_ReadRawInto(b *testing.B) {
+	img, rbdTest := benchmarkImage(b, "bench_read_raw_into")
+	defer endImage(rbdTest, img)
+	buf := make([]byte, 4096)
+	for i := 0; i < b.N; i++ {
+		img.ReadRawInto(buf, 0)
+	}
+}
+
+func Benchmark_WriteRaw(b *testing.B) {
+	img, rbdTest := benchmarkImage(b, "bench_write_raw")
+	defer endImage(rbdTest, img)
+	data := strings.Repeat("a", 4096)
+	for i := 0; i < b.N; i++ {
+		img.WriteRaw(data, 0)
+	}
+}
+
+func Benchmark_WriteRawFrom(b *testing.B) {
+	img, rbdTest := benchmarkImage(b, "bench_write_raw_from")
+	defer endImage(rbdTest, img)
+	buf := make([]byte, 4096)
+	for i := 0; i < b.N; i++ {
+		img.WriteRawFrom(buf, 0)
+	}
+}
+
+func Benchmark_BufferPool(b *testing.B) {
+	pool := NewBufferPool(copyChunkSize)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pool.Put(pool.Get())
+		}
+	})
+}
+
+func Test_ParallelReader(t *testing.T) {
+	img, rbdTest := getImageSized(t, "parallel_reader", 16<<20, Layering())
+	defer endImage(rbdTest, img)
+	data := make([]byte, 10<<20)
+	for i := range data {
+		data[i] = byte(i / 4099)
+	}
+	_, err := img.WriteAt(data, 1<<20+3)
+	checkFatal(t, err, "Cannot write to %s", img.name)
+
+	pr, err := NewParallelReader(img, 1<<20+3, uint64(len(data)), 3)
+	checkFatal(t, err, "Cannot create a parallel reader of %s", img.name)
+	defer pr.Close()
+	got, err := ioutil.ReadAll(pr)
+	checkFatal(t, err, "Cannot read %s in parallel", img.name)
+	if !bytes.Equal(got, data) {
+		t.Errorf("Wrong data read in parallel from %s", img.name)
+	}
+}
+
+func Test_ParallelReaderChunks(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	pr := newParallelReader(bytes.NewReader(data), 10, 2000, 64, 4)
+	got, err := ioutil.ReadAll(pr)
+	if err != nil || !bytes.Equal(got, data[10:]) {
+		t.Errorf("Wrong data read in parallel: %d bytes, %v", len(got), err)
+	}
+	pr.Close()
+
+	pr = newParallelReader(bytes.NewReader(data), 0, 1000, 16, 2)
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(pr, buf); err != nil || !bytes.Equal(buf, data[:10]) {
+		t.Errorf("Wrong data read in parallel: %v, %v", buf, err)
+	}
+	pr.Close()
+	if pr.buf != nil {
+		t.Errorf("Buffer being read not returned to the pool on Close")
+	}
+	if _, err := pr.Read(buf); err != ErrClosed {
+		t.Errorf("Wrong error reading after Close: %v", err)
+	}
+}
+
+func Test_BlockCache(t *testing.T) {
+	img, rbdTest := getImage(t, "block_cache", Layering())
+	defer endImage(rbdTest, img)
+	data := bytes.Repeat([]byte("golden"), 2000)
+	_, err := img.WriteAt(data, 100)
+	checkFatal(t, err, "Cannot write to %s", img.name)
+	checkFatal(t, img.CreateSnap("golden"), "Cannot snapshot %s", img.name)
+	defer img.RemoveSnap("golden")
+
+	cache := NewBlockCache(64<<10, 4096, 1)
+	if _, err := cache.Wrap(img); err != ErrNotSnapshot {
+		t.Errorf("Wrong error caching %s: %v", img.name, err)
+	}
+	for i := 0; i < 2; i++ {
+		snapImg, err := NewImage(rbdTest.r, img.name, ReadOnly, SnapshotName("golden"))
+		checkFatal(t, err, "Cannot open %s at golden", img.name)
+		cached, err := cache.Wrap(snapImg)
+		checkFatal(t, err, "Cannot cache %s", img.name)
+		buf := make([]byte, len(data))
+		_, err = cached.ReadAt(buf, 100)
+		checkFatal(t, err, "Cannot read %s through the cache", img.name)
+		if !bytes.Equal(buf, data) {
+			t.Errorf("Wrong data read from %s through the cache", img.name)
+		}
+		if i == 1 {
+			checkFatal(t, cached.InvalidateCache(), "Cannot invalidate the cache of %s", img.name)
+		}
+		cached.Close()
+	}
+	stats := cache.Stats()
+	if stats.Misses != 2 || stats.Hits != 4 || stats.Blocks != 0 {
+		t.Errorf("Wrong cache statistics: %+v", stats)
+	}
+}
+
+func Test_BlockCacheEviction(t *testing.T) {
+	cache := NewBlockCache(2*4096, 4096, 0)
+	for block := int64(0); block < 3; block++ {
+		cache.put(blockKey{"pool", "id", 1, block}, []byte{byte(block)})
+	}
+	if _, ok := cache.get(blockKey{"pool", "id", 1, 0}); ok {
+		t.Errorf("The least recently used block was not evicted")
+	}
+	if data, ok := cache.get(blockKey{"pool", "id", 1, 2}); !ok || data[0] != 2 {
+		t.Errorf("Wrong cached block: %v, %v", data, ok)
+	}
+	cache.invalidate("pool", "id", 2)
+	if stats := cache.Stats(); stats.Blocks != 2 || stats.Evictions != 1 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Wrong cache statistics: %+v", stats)
+	}
+	cache.invalidate("pool", "id", 1)
+	if stats := cache.Stats(); stats.Blocks != 0 {
+		t.Errorf("Blocks left after invalidation: %+v", stats)
+	}
+
+	cached := &CachedImage{&Image{name: "image"}, cache, "id", 1, 4096}
+	if _, err := cached.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Errorf("Read at a negative offset accepted")
+	}
+}
+
+func Test_Throttled(t *testing.T) {
+	img, rbdTest := getImage(t, "throttled", Layering())
+	defer endImage(rbdTest, img)
+	group := NewLimiter(Limits{BytesPerSecond: 1 << 20})
+	throttled := Throttle(img, Background, NewLimiter(Limits{IOPS: 100}), group)
+	buf := bytes.Repeat([]byte{1}, 512<<10)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := throttled.WriteAt(buf, int64(i*len(buf)))
+		checkFatal(t, err, "Cannot write to %s", img.name)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Writes to %s not throttled: 1.5MiB written in %v", img.name, elapsed)
+	}
+
+	dst, dstTest := getImage(t, "throttled_copy", Layering())
+	defer endImage(dstTest, dst)
+	written, err := throttled.CopySparse(dst)
+	checkFatal(t, err, "Cannot copy %s", img.name)
+	if written != int64(3*len(buf)) {
+		t.Errorf("Wrong number of bytes copied from %s: %d", img.name, written)
+	}
+
+	// every I/O entry point waits for the limiters
+	slow := NewLimiter(Limits{IOPS: 10})
+	for i := 0; i < 10; i++ {
+		slow.Wait(context.Background(), Normal, 0)
+	}
+	limited := Throttle(img, Normal, slow)
+	small := make([]byte, 512)
+	start = time.Now()
+	limited.Read(small)
+	limited.Write(small)
+	limited.ReadRaw(0, 512)
+	limited.WriteRaw("test", 0)
+	if cp, err := limited.AioReadV(0, [][]byte{small}); err == nil {
+		cp.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("I/Os of %s not throttled: 5 I/Os at 10 IOPS done in %v", img.name, elapsed)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, call := range map[string]func() error{
+		"ReadRawInto":  func() error { _, err := limited.ReadRawIntoContext(ctx, small, 0); return err },
+		"WriteRawFrom": func() error { _, err := limited.WriteRawFromContext(ctx, small, 0); return err },
+		"ReadV":        func() error { _, err := limited.ReadVContext(ctx, 0, [][]byte{small}); return err },
+		"WriteV":       func() error { _, err := limited.WriteVContext(ctx, 0, [][]byte{small}); return err },
+		"WriteSame":    func() error { return limited.WriteSameContext(ctx, 0, 512, []byte{1}) },
+		"WriteZeroes":  func() error { return limited.WriteZeroesContext(ctx, 0, 512, 0) },
+		"CompareAndWrite": func() error {
+			_, err := limited.CompareAndWriteContext(ctx, 0, small, small)
+			return err
+		},
+	} {
+		if err := call(); err != context.Canceled {
+			t.Errorf("%s of %s not throttled, expected %v, got %v", name, img.name, context.Canceled, err)
+		}
+	}
+}
+
+func Test_ThrottledRefund(t *testing.T) {
+	first := NewLimiter(Limits{IOPS: 10})
+	second := NewLimiter(Limits{IOPS: 1})
+	second.Wait(context.Background(), Normal, 0)
+	throttled := Throttle(nil, Normal, first, second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := throttled.wait(ctx, 0); err != context.Canceled {
+		t.Fatalf("Wrong error waiting for a drained limiter: %v", err)
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if first.ops.tokens < 10 {
+		t.Errorf("Tokens of the first limiter not given back: %v left", first.ops.tokens)
+	}
+	if n := clampLength(math.MaxUint64); n != math.MaxInt {
+		t.Errorf("Wrong clamped length: %d", n)
+	}
+}
+
+func Test_LimiterPriority(t *testing.T) {
+	l := NewLimiter(Limits{IOPS: 10})
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		l.Wait(ctx, Normal, 0)
+	}
+	queued := func(p Priority, n int) {
+		for {
+			l.mu.Lock()
+			done := len(l.queues[p]) == n
+			l.mu.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	order := make(chan Priority, 2)
+	for _, p := range []Priority{Background, Interactive} {
+		go func(p Priority) {
+			l.Wait(ctx, p, 0)
+			order <- p
+		}(p)
+		queued(p, 1)
+	}
+	if first := <-order; first != Interactive {
+		t.Errorf("Wrong priority served first: %v", first)
+	}
+	<-order
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.Wait(cancelled, Normal, 0); err != context.Canceled {
+		t.Errorf("Wrong error waiting with a cancelled context: %v", err)
+	}
+	queued(Normal, 0)
+}
+
+func Test_ErrorMessage(t *testing.T) {
+	err := &cError{"Cannot open image test", 0, -2}
+	if !strings.Contains(err.Error(), "Image Not Found") {
+		t.Errorf("Wrong message for ENOENT: %s", err)
+	}
+	for _, test := range []struct {
+		err *cError
+		msg string
+	}{
+		{&cError{"Cannot clone", 0, -22}, "Snap should be protected"}, // EINVAL
+		{&cError{"Cannot remove", 0, -16}, "Snap is not protected"},   // EBUSY
+		{&cError{"Cannot resize", 0, 22}, "Invalid Argument"},
+		{&cError{"Cannot read", 0, -108}, "Connection Shutdown"}, // ESHUTDOWN
+	} {
+		if !strings.Contains(test.err.Error(), test.msg) {
+			t.Errorf("Wrong message, expected %q, got %s", test.msg, test.err)
+		}
+	}
+	if !IsBlocklisted(&cError{"Cannot read", 0, -108}) {
+		t.Errorf("ESHUTDOWN not reported as blocklisting")
+	}
+}
+
+func Test_RetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond}
+	timeout := &cError{"Cannot read", 0, -110} // ETIMEDOUT
+	calls := 0
+	err := policy.Do(context.Background(), "read", func() error {
+		calls++
+		if calls < 3 {
+			return timeout
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Wrong retries of a transient error: %d calls, %v", calls, err)
+	}
+
+	blocklisted := &cError{"Cannot flush", 0, -108} // EBLOCKLISTED
+	all := RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, Retryable: func(error) bool { return true }}
+	for _, op := range []string{"flush", "flatten"} {
+		calls = 0
+		all.Do(context.Background(), op, func() error {
+			calls++
+			return blocklisted
+		})
+		if calls != 1 {
+			t.Errorf("%s retried after blocklisting: %d calls", op, calls)
+		}
+	}
+
+	calls = 0
+	err = policy.Do(context.Background(), "read", func() error {
+		calls++
+		return timeout
+	})
+	if err != timeout || calls != 4 {
+		t.Errorf("Wrong retries of a persistent error: %d calls, %v", calls, err)
+	}
+
+	calls = 0
+	policy.Do(context.Background(), "create_snap", func() error {
+		calls++
+		return timeout
+	})
+	if calls != 1 {
+		t.Errorf("Non idempotent operation called %d times", calls)
+	}
+
+	calls = 0
+	policy.Do(context.Background(), "read", func() error {
+		calls++
+		return io.EOF
+	})
+	if calls != 1 {
+		t.Errorf("Non transient error retried %d times", calls)
+	}
+}
+
+func Test_RetryingImage(t *testing.T) {
+	img, rbdTest := getImage(t, "retrying_image", Layering())
+	name := img.name
+	img.Close()
+	defer rbdTest.r.Remove(name)
+	ri, err := OpenRetrying(rbdTest.r, name, RetryPolicy{InitialBackoff: time.Millisecond})
+	checkFatal(t, err, "Cannot open %s", name)
+	defer ri.Close()
+	_, err = ri.WriteAt([]byte("fenced"), 0)
+	checkFatal(t, err, "Cannot write to %s", name)
+
+	first, _ := ri.Image()
+	calls := 0
+	buf := make([]byte, 6)
+	err = ri.Do(context.Background(), "read", func(img *Image) error {
+		calls++
+		if calls == 1 {
+			return &cError{"Cannot read", 0, -108} // EBLOCKLISTED
+		}
+		_, err := img.ReadAt(buf, 0)
+		return err
+	})
+	checkFatal(t, err, "Cannot read %s after reopening it", name)
+	if second, _ := ri.Image(); second == first || calls != 2 || string(buf) != "fenced" {
+		t.Errorf("%s not reopened after blocklisting: %d calls, %q", name, calls, buf)
+	}
+
+	// the cached writes of a fenced handle may be lost, flush fails
+	second, _ := ri.Image()
+	calls = 0
+	err = ri.Do(context.Background(), "flush", func(img *Image) error {
+		calls++
+		return &cError{"Cannot flush", 0, -108} // EBLOCKLISTED
+	})
+	if !IsBlocklisted(err) || calls != 1 {
+		t.Errorf("Flush of %s retried after blocklisting: %d calls, %v", name, calls, err)
+	}
+	if third, _ := ri.Image(); third == second {
+		t.Errorf("%s not reopened after the failed flush", name)
+	}
+}
@@ -0,0 +1,93 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+)
+
+// ErrClosed is returned by the methods of an Image or a Rbd after it was
+// closed.
+var ErrClosed = errors.New("rbd: use of a closed handle")
+
+// LeakLog receives a warning for each Image and Rbd garbage collected
+// without having been closed.  Nothing is logged when it is nil.
+var LeakLog = log.New(os.Stderr, "rbd: ", log.LstdFlags)
+
+// caller returns the location of the caller of the function calling
+// caller, to tell where leaked handles were opened.
+func caller() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown location"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+func warnLeak(format string, args ...interface{}) {
+	if LeakLog != nil {
+		LeakLog.Printf(format, args...)
+	}
+}
+
+// lock read-locks img for the duration of a librbd call, so that it is not
+// closed meanwhile.  It fails with ErrClosed if img is closed.
+func (img *Image) lock() error {
+	img.mu.RLock()
+	if img.closed {
+		img.mu.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (img *Image) unlock() {
+	img.mu.RUnlock()
+}
+
+func leakedImage(img *Image) {
+	if !img.closed {
+		warnLeak("image %s opened at %s was not closed", img.name, img.openedAt)
+	}
+}
+
+// lock read-locks r for the duration of a librbd call, so that its ioctx
+// is not destroyed meanwhile.  It fails with ErrClosed if r is closed.
+func (r *Rbd) lock() error {
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (r *Rbd) unlock() {
+	r.mu.RUnlock()
+}
+
+func leakedRbd(r *Rbd) {
+	if !r.closed {
+		warnLeak("rbd of pool %s opened at %s was not closed", r.PoolName, r.openedAt)
+	}
+}
+
+// Close destroys the ioctx of the pool.  It waits for the calls in
+// progress.  Closing a closed Rbd does nothing.  The images opened
+// through r must be closed first.
+func (r *Rbd) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	runtime.SetFinalizer(r, nil)
+	if r.rados != nil {
+		r.rados.IoCtxDestroy(r.ctx)
+	}
+	r.ctx = 0
+	return nil
+}
@@ -0,0 +1,90 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+*/
+import "C"
+import "fmt"
+import "unsafe"
+import "context"
+import "time"
+
+// GetMetadata gets the value of a metadata key of the image.
+func (img *Image) GetMetadata(key string) (string, error) {
+	return img.GetMetadataContext(context.Background(), key)
+}
+
+// GetMetadataContext is GetMetadata passing ctx to the observer.
+func (img *Image) GetMetadataContext(ctx context.Context, key string) (_ string, err error) {
+	defer img.observe(ctx, "get_metadata", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return "", err
+	}
+	defer img.unlock()
+	keyC := C.CString(key)
+	defer C.free(unsafe.Pointer(keyC))
+	sizeC := C.size_t(64)
+	var value []byte
+	var retC C.int
+	for {
+		value = make([]byte, int(sizeC))
+		retC = C.rbd_metadata_get(img.getC(), keyC, (*C.char)(unsafe.Pointer(&value[0])), &sizeC)
+		if retC != -C.ERANGE {
+			break
+		}
+	}
+	if retC < 0 {
+		return "", &cError{fmt.Sprintf("Cannot get metadata %s of image %s", key, img.name), 0, retC}
+	}
+	return C.GoString((*C.char)(unsafe.Pointer(&value[0]))), nil
+}
+
+// SetMetadata sets a metadata key of the image.
+func (img *Image) SetMetadata(key string, value string) error {
+	return img.SetMetadataContext(context.Background(), key, value)
+}
+
+// SetMetadataContext is SetMetadata passing ctx to the observer.
+func (img *Image) SetMetadataContext(ctx context.Context, key string, value string) (err error) {
+	defer img.observe(ctx, "set_metadata", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	keyC := C.CString(key)
+	defer C.free(unsafe.Pointer(keyC))
+	valueC := C.CString(value)
+	defer C.free(unsafe.Pointer(valueC))
+
+	retC := C.rbd_metadata_set(img.getC(), keyC, valueC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot set metadata %s of image %s", key, img.name), 0, retC}
+	}
+	return nil
+}
+
+// RemoveMetadata removes a metadata key of the image.
+func (img *Image) RemoveMetadata(key string) error {
+	return img.RemoveMetadataContext(context.Background(), key)
+}
+
+// RemoveMetadataContext is RemoveMetadata passing ctx to the observer.
+func (img *Image) RemoveMetadataContext(ctx context.Context, key string) (err error) {
+	defer img.observe(ctx, "remove_metadata", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	keyC := C.CString(key)
+	defer C.free(unsafe.Pointer(keyC))
+
+	retC := C.rbd_metadata_remove(img.getC(), keyC)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot remove metadata %s of image %s", key, img.name), 0, retC}
+	}
+	return nil
+}
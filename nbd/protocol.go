@@ -0,0 +1,83 @@
+package nbd
+
+// Constants of the NBD newstyle protocol, see
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+
+const (
+	nbdMagic         uint64 = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic         uint64 = 0x49484156454F5054 // "IHAVEOPT"
+	optReplyMagic    uint64 = 0x3e889045565a9
+	requestMagic     uint32 = 0x25609513
+	simpleReplyMagic uint32 = 0x67446698
+	structReplyMagic uint32 = 0x668e33ef
+)
+
+// handshake flags, sent by the server, and client flags.
+const (
+	flagFixedNewstyle uint16 = 1 << 0
+	flagNoZeroes      uint16 = 1 << 1
+)
+
+// options.
+const (
+	optExportName      uint32 = 1
+	optAbort           uint32 = 2
+	optList            uint32 = 3
+	optInfo            uint32 = 6
+	optGo              uint32 = 7
+	optStructuredReply uint32 = 8
+)
+
+// option replies.
+const (
+	repAck         uint32 = 1
+	repServer      uint32 = 2
+	repInfo        uint32 = 3
+	repErrUnsup    uint32 = 1<<31 + 1
+	repErrInvalid  uint32 = 1<<31 + 3
+	repErrUnknown  uint32 = 1<<31 + 6
+	infoExport     uint16 = 0
+	maxOptionBytes        = 64 * 1024
+)
+
+// transmission flags.
+const (
+	flagHasFlags        uint16 = 1 << 0
+	flagReadOnly        uint16 = 1 << 1
+	flagSendFlush       uint16 = 1 << 2
+	flagSendFUA         uint16 = 1 << 3
+	flagSendTrim        uint16 = 1 << 5
+	flagSendWriteZeroes uint16 = 1 << 6
+)
+
+// commands and their flags.
+const (
+	cmdRead        uint16 = 0
+	cmdWrite       uint16 = 1
+	cmdDisc        uint16 = 2
+	cmdFlush       uint16 = 3
+	cmdTrim        uint16 = 4
+	cmdWriteZeroes uint16 = 6
+	cmdFlagFUA     uint16 = 1 << 0
+	cmdFlagNoHole  uint16 = 1 << 1
+)
+
+// structured reply chunks.
+const (
+	replyFlagDone        uint16 = 1 << 0
+	replyTypeNone        uint16 = 0
+	replyTypeOffsetData  uint16 = 1
+	replyTypeError       uint16 = 1<<15 + 1
+	maxRequestBytes             = 32 * 1024 * 1024
+	exportNameReplyZeros        = 124
+)
+
+// errors returned to the client.
+const (
+	errPerm     uint32 = 1
+	errIO       uint32 = 5
+	errInval    uint32 = 22
+	errNoSpc    uint32 = 28
+	errOverflow uint32 = 75
+	errNotSup   uint32 = 95
+)
@@ -0,0 +1,379 @@
+// Package nbd serves rbd images over the NBD protocol, so they can be
+// attached with nbd-client or qemu without the kernel rbd module.
+//
+// Only the fixed newstyle handshake is supported.  Structured replies are
+// used for reads when the client asks for them.
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Device is the block device exported by the server.  *rbd.Image
+// implements it.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (uint64, error)
+	Discard(offset int, length int) error
+	Flush() error
+	IsReadOnly() bool
+}
+
+// ZeroWriter is implemented by the devices able to zero a range without
+// transferring zeroes, like *rbd.Image.  The server uses it, when
+// available, for the write zeroes requests.
+type ZeroWriter interface {
+	// WriteZeroes zeroes length bytes at offset, allocating them when
+	// flags is rbd.WriteZeroesThickProvision.
+	WriteZeroes(offset uint64, length uint64, flags int) error
+}
+
+// writeZeroesThickProvision is the value of rbd.WriteZeroesThickProvision,
+// not imported so that the package does not depend on librbd.
+const writeZeroesThickProvision = 1
+
+// Server exports a Device under a name.
+type Server struct {
+	name string
+	dev  Device
+	// ErrorLog receives the errors of the connections served by Serve.
+	// Nothing is logged when it is nil.
+	ErrorLog *log.Logger
+}
+
+// NewServer returns a server exporting dev under name.  Clients asking
+// for the default, empty, export name get dev too.
+func NewServer(name string, dev Device) *Server {
+	return &Server{name: name, dev: dev}
+}
+
+// Serve accepts connections on l, on a Unix or a TCP socket, and serves
+// each of them in its own goroutine.  It returns when l fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(c); err != nil && s.ErrorLog != nil {
+				s.ErrorLog.Printf("nbd: %s: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn negotiates the export with the client and serves its
+// requests until it disconnects.  The connection is closed on return.
+func (s *Server) ServeConn(c net.Conn) error {
+	defer c.Close()
+	cn := &conn{s: s, c: c}
+	ok, err := cn.negotiate()
+	if err != nil || !ok {
+		return err
+	}
+	return cn.transmit()
+}
+
+// conn is the state of a client connection.
+type conn struct {
+	s          *Server
+	c          net.Conn
+	size       uint64
+	flags      uint16
+	structured bool
+	wmu        sync.Mutex
+}
+
+// write sends data in a single write, so that concurrent replies are not
+// interleaved on the connection.
+func (cn *conn) write(data ...interface{}) error {
+	var buf bytes.Buffer
+	for _, d := range data {
+		if err := binary.Write(&buf, binary.BigEndian, d); err != nil {
+			return err
+		}
+	}
+	_, err := cn.c.Write(buf.Bytes())
+	return err
+}
+
+func (cn *conn) read(data ...interface{}) error {
+	for _, d := range data {
+		if err := binary.Read(cn.c, binary.BigEndian, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cn *conn) optReply(opt uint32, typ uint32, data []byte) error {
+	return cn.write(optReplyMagic, opt, typ, uint32(len(data)), data)
+}
+
+func (cn *conn) exportInfo() error {
+	size, err := cn.s.dev.Size()
+	if err != nil {
+		return err
+	}
+	cn.size = size
+	cn.flags = flagHasFlags | flagSendFlush | flagSendFUA | flagSendTrim | flagSendWriteZeroes
+	if cn.s.dev.IsReadOnly() {
+		cn.flags |= flagReadOnly
+	}
+	return nil
+}
+
+func (cn *conn) knownExport(name string) bool {
+	return name == "" || name == cn.s.name
+}
+
+// negotiate runs the handshake.  It returns true when the client is ready
+// for the transmission phase.
+func (cn *conn) negotiate() (bool, error) {
+	if err := cn.write(nbdMagic, optMagic, flagFixedNewstyle|flagNoZeroes); err != nil {
+		return false, err
+	}
+	var clientFlags uint32
+	if err := cn.read(&clientFlags); err != nil {
+		return false, err
+	}
+	if clientFlags&uint32(flagFixedNewstyle) == 0 {
+		return false, fmt.Errorf("Client does not support the fixed newstyle handshake")
+	}
+	noZeroes := clientFlags&uint32(flagNoZeroes) != 0
+
+	for {
+		var magic uint64
+		var opt, length uint32
+		if err := cn.read(&magic, &opt, &length); err != nil {
+			return false, err
+		}
+		if magic != optMagic {
+			return false, fmt.Errorf("Wrong option magic %#x", magic)
+		}
+		if length > maxOptionBytes {
+			return false, fmt.Errorf("Option %d too long (%d bytes)", opt, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(cn.c, data); err != nil {
+			return false, err
+		}
+
+		var err error
+		switch opt {
+		case optExportName:
+			if !cn.knownExport(string(data)) {
+				return false, fmt.Errorf("Unknown export %q", string(data))
+			}
+			if err := cn.exportInfo(); err != nil {
+				return false, err
+			}
+			if err := cn.write(cn.size, cn.flags); err != nil {
+				return false, err
+			}
+			if !noZeroes {
+				err = cn.write(make([]byte, exportNameReplyZeros))
+			}
+			return err == nil, err
+		case optAbort:
+			return false, cn.optReply(opt, repAck, nil)
+		case optList:
+			if length != 0 {
+				err = cn.optReply(opt, repErrInvalid, nil)
+				break
+			}
+			name := make([]byte, 4+len(cn.s.name))
+			binary.BigEndian.PutUint32(name, uint32(len(cn.s.name)))
+			copy(name[4:], cn.s.name)
+			if err = cn.optReply(opt, repServer, name); err == nil {
+				err = cn.optReply(opt, repAck, nil)
+			}
+		case optStructuredReply:
+			if length != 0 {
+				err = cn.optReply(opt, repErrInvalid, nil)
+				break
+			}
+			cn.structured = true
+			err = cn.optReply(opt, repAck, nil)
+		case optInfo, optGo:
+			var done bool
+			done, err = cn.infoGo(opt, data)
+			if done && err == nil {
+				return true, nil
+			}
+		default:
+			err = cn.optReply(opt, repErrUnsup, nil)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// infoGo answers NBD_OPT_INFO and NBD_OPT_GO.  It returns true when the
+// export is selected.
+func (cn *conn) infoGo(opt uint32, data []byte) (bool, error) {
+	if len(data) < 6 {
+		return false, cn.optReply(opt, repErrInvalid, nil)
+	}
+	nameLen := binary.BigEndian.Uint32(data)
+	if uint64(nameLen)+6 > uint64(len(data)) {
+		return false, cn.optReply(opt, repErrInvalid, nil)
+	}
+	name := string(data[4 : 4+nameLen])
+	nInfo := binary.BigEndian.Uint16(data[4+nameLen:])
+	if int(4+nameLen+2)+2*int(nInfo) != len(data) {
+		return false, cn.optReply(opt, repErrInvalid, nil)
+	}
+	if !cn.knownExport(name) {
+		return false, cn.optReply(opt, repErrUnknown, nil)
+	}
+	if err := cn.exportInfo(); err != nil {
+		return false, err
+	}
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info, infoExport)
+	binary.BigEndian.PutUint64(info[2:], cn.size)
+	binary.BigEndian.PutUint16(info[10:], cn.flags)
+	if err := cn.optReply(opt, repInfo, info); err != nil {
+		return false, err
+	}
+	if err := cn.optReply(opt, repAck, nil); err != nil {
+		return false, err
+	}
+	return opt == optGo, nil
+}
+
+// request is a transmission phase request.
+type request struct {
+	flags  uint16
+	typ    uint16
+	handle uint64
+	offset uint64
+	length uint32
+	data   []byte
+}
+
+// transmit serves the requests until the client disconnects.
+func (cn *conn) transmit() error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		var magic uint32
+		req := &request{}
+		if err := cn.read(&magic, &req.flags, &req.typ, &req.handle, &req.offset, &req.length); err != nil {
+			return err
+		}
+		if magic != requestMagic {
+			return fmt.Errorf("Wrong request magic %#x", magic)
+		}
+		switch req.typ {
+		case cmdDisc:
+			return nil
+		case cmdWrite:
+			if req.length > maxRequestBytes {
+				return fmt.Errorf("Write request too long (%d bytes)", req.length)
+			}
+			req.data = make([]byte, req.length)
+			if _, err := io.ReadFull(cn.c, req.data); err != nil {
+				return err
+			}
+		case cmdRead:
+			if req.length > maxRequestBytes {
+				if err := cn.reply(req, errOverflow, nil); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errno, data := cn.handle(req)
+			if err := cn.reply(req, errno, data); err != nil {
+				cn.c.Close()
+			}
+		}()
+	}
+}
+
+// handle runs a request against the device.  It returns the NBD error
+// and, for reads, the data.
+func (cn *conn) handle(req *request) (uint32, []byte) {
+	dev := cn.s.dev
+	if req.offset+uint64(req.length) > cn.size || req.offset+uint64(req.length) < req.offset {
+		if req.typ == cmdRead {
+			return errInval, nil
+		}
+		return errNoSpc, nil
+	}
+	if req.typ != cmdRead && req.typ != cmdFlush && cn.flags&flagReadOnly != 0 {
+		return errPerm, nil
+	}
+	var err error
+	switch req.typ {
+	case cmdRead:
+		data := make([]byte, req.length)
+		n, err := dev.ReadAt(data, int64(req.offset))
+		if err != nil && !(err == io.EOF && n == len(data)) {
+			return errIO, nil
+		}
+		return 0, data
+	case cmdWrite:
+		_, err = dev.WriteAt(req.data, int64(req.offset))
+	case cmdFlush:
+		err = dev.Flush()
+	case cmdTrim:
+		err = dev.Discard(int(req.offset), int(req.length))
+	case cmdWriteZeroes:
+		noHole := req.flags&cmdFlagNoHole != 0
+		if zw, ok := dev.(ZeroWriter); ok {
+			flags := 0
+			if noHole {
+				flags = writeZeroesThickProvision
+			}
+			err = zw.WriteZeroes(req.offset, uint64(req.length), flags)
+		} else if noHole {
+			_, err = dev.WriteAt(make([]byte, req.length), int64(req.offset))
+		} else {
+			err = dev.Discard(int(req.offset), int(req.length))
+		}
+	default:
+		return errInval, nil
+	}
+	if err == nil && req.flags&cmdFlagFUA != 0 {
+		err = dev.Flush()
+	}
+	if err != nil {
+		return errIO, nil
+	}
+	return 0, nil
+}
+
+// reply sends the answer to req.  Structured replies are only used for
+// reads, as allowed by the protocol.
+func (cn *conn) reply(req *request, errno uint32, data []byte) error {
+	cn.wmu.Lock()
+	defer cn.wmu.Unlock()
+	if !cn.structured || req.typ != cmdRead {
+		if err := cn.write(simpleReplyMagic, errno, req.handle); err != nil {
+			return err
+		}
+		if errno == 0 && req.typ == cmdRead {
+			return cn.write(data)
+		}
+		return nil
+	}
+	if errno != 0 {
+		return cn.write(structReplyMagic, replyFlagDone, replyTypeError, req.handle, uint32(6), errno, uint16(0))
+	}
+	return cn.write(structReplyMagic, replyFlagDone, replyTypeOffsetData, req.handle, uint32(8+len(data)), req.offset, data)
+}
@@ -0,0 +1,266 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+type memDevice struct {
+	mu       sync.Mutex
+	data     []byte
+	readOnly bool
+	flushes  int
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(p, d.data[off:]), nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memDevice) Size() (uint64, error) {
+	return uint64(len(d.data)), nil
+}
+
+func (d *memDevice) Discard(offset int, length int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	copy(d.data[offset:offset+length], make([]byte, length))
+	return nil
+}
+
+func (d *memDevice) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushes++
+	return nil
+}
+
+func (d *memDevice) IsReadOnly() bool {
+	return d.readOnly
+}
+
+// zeroDevice is a memDevice implementing ZeroWriter.
+type zeroDevice struct {
+	memDevice
+	zeroFlags []int
+}
+
+func (d *zeroDevice) WriteZeroes(offset uint64, length uint64, flags int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	copy(d.data[offset:offset+length], make([]byte, length))
+	d.zeroFlags = append(d.zeroFlags, flags)
+	return nil
+}
+
+type testClient struct {
+	t *testing.T
+	c net.Conn
+}
+
+func (tc *testClient) write(data ...interface{}) {
+	var buf bytes.Buffer
+	for _, d := range data {
+		binary.Write(&buf, binary.BigEndian, d)
+	}
+	if _, err := tc.c.Write(buf.Bytes()); err != nil {
+		tc.t.Fatalf("Cannot write to the server: %v", err)
+	}
+}
+
+func (tc *testClient) read(data ...interface{}) {
+	for _, d := range data {
+		if err := binary.Read(tc.c, binary.BigEndian, d); err != nil {
+			tc.t.Fatalf("Cannot read from the server: %v", err)
+		}
+	}
+}
+
+// optReply reads an option reply and returns its type and data.
+func (tc *testClient) optReply(opt uint32) (uint32, []byte) {
+	var magic uint64
+	var gotOpt, typ, length uint32
+	tc.read(&magic, &gotOpt, &typ, &length)
+	if magic != optReplyMagic || gotOpt != opt {
+		tc.t.Fatalf("Wrong option reply %#x for %d", magic, gotOpt)
+	}
+	data := make([]byte, length)
+	tc.read(data)
+	return typ, data
+}
+
+// connect runs the handshake with OPT_GO and returns the export size and
+// transmission flags.
+func connect(t *testing.T, dev Device, name string, structured bool) (*testClient, uint64, uint16) {
+	server, client := net.Pipe()
+	go NewServer("test", dev).ServeConn(server)
+	tc := &testClient{t, client}
+
+	var magic, opt uint64
+	var flags uint16
+	tc.read(&magic, &opt, &flags)
+	if magic != nbdMagic || opt != optMagic || flags&flagFixedNewstyle == 0 {
+		t.Fatalf("Wrong handshake %#x %#x %#x", magic, opt, flags)
+	}
+	tc.write(uint32(flagFixedNewstyle | flagNoZeroes))
+	if structured {
+		tc.write(optMagic, optStructuredReply, uint32(0))
+		if typ, _ := tc.optReply(optStructuredReply); typ != repAck {
+			t.Fatalf("Structured replies refused: %#x", typ)
+		}
+	}
+	tc.write(optMagic, optGo, uint32(4+len(name)+2), uint32(len(name)), []byte(name), uint16(0))
+	typ, info := tc.optReply(optGo)
+	if typ != repInfo {
+		return tc, 0, 0
+	}
+	if typ, _ := tc.optReply(optGo); typ != repAck {
+		t.Fatalf("Go not acknowledged: %#x", typ)
+	}
+	return tc, binary.BigEndian.Uint64(info[2:]), binary.BigEndian.Uint16(info[10:])
+}
+
+func (tc *testClient) request(typ uint16, flags uint16, handle uint64, offset uint64, length uint32, data []byte) {
+	tc.write(requestMagic, flags, typ, handle, offset, length, data)
+}
+
+func (tc *testClient) simpleReply(handle uint64) uint32 {
+	var magic, errno uint32
+	var gotHandle uint64
+	tc.read(&magic, &errno, &gotHandle)
+	if magic != simpleReplyMagic || gotHandle != handle {
+		tc.t.Fatalf("Wrong simple reply %#x for %d", magic, gotHandle)
+	}
+	return errno
+}
+
+func Test_Handshake(t *testing.T) {
+	dev := &memDevice{data: make([]byte, 4096)}
+	tc, size, flags := connect(t, dev, "test", false)
+	defer tc.c.Close()
+	if size != 4096 {
+		t.Errorf("Wrong export size, expected 4096, got %d", size)
+	}
+	if flags&flagReadOnly != 0 || flags&flagSendTrim == 0 || flags&flagSendFlush == 0 {
+		t.Errorf("Wrong transmission flags %#x", flags)
+	}
+	tc.request(cmdDisc, 0, 1, 0, 0, nil)
+
+	tc2, _, _ := connect(t, dev, "unknown", false)
+	defer tc2.c.Close()
+}
+
+func Test_ReadWrite(t *testing.T) {
+	dev := &memDevice{data: make([]byte, 4096)}
+	tc, _, _ := connect(t, dev, "", false)
+	defer tc.c.Close()
+
+	buf := []byte("test_nbd")
+	tc.request(cmdWrite, cmdFlagFUA, 1, 100, uint32(len(buf)), buf)
+	if errno := tc.simpleReply(1); errno != 0 {
+		t.Fatalf("Write failed: %d", errno)
+	}
+	if !bytes.Equal(dev.data[100:100+len(buf)], buf) || dev.flushes != 1 {
+		t.Errorf("Wrong write, got %s with %d flushes", dev.data[100:100+len(buf)], dev.flushes)
+	}
+
+	tc.request(cmdRead, 0, 2, 100, uint32(len(buf)), nil)
+	if errno := tc.simpleReply(2); errno != 0 {
+		t.Fatalf("Read failed: %d", errno)
+	}
+	readBuf := make([]byte, len(buf))
+	tc.read(readBuf)
+	if !bytes.Equal(buf, readBuf) {
+		t.Errorf("Wrong read, expected %s, got %s", buf, readBuf)
+	}
+
+	tc.request(cmdTrim, 0, 3, 100, 4, nil)
+	if errno := tc.simpleReply(3); errno != 0 {
+		t.Fatalf("Trim failed: %d", errno)
+	}
+	tc.request(cmdWriteZeroes, cmdFlagNoHole, 4, 104, 4, nil)
+	if errno := tc.simpleReply(4); errno != 0 {
+		t.Fatalf("Write zeroes failed: %d", errno)
+	}
+	if !bytes.Equal(dev.data[100:100+len(buf)], make([]byte, len(buf))) {
+		t.Errorf("Data not zeroed, got %v", dev.data[100:100+len(buf)])
+	}
+
+	tc.request(cmdRead, 0, 5, 4090, 10, nil)
+	if errno := tc.simpleReply(5); errno != errInval {
+		t.Errorf("Read past the end should fail with EINVAL, got %d", errno)
+	}
+	tc.request(cmdDisc, 0, 6, 0, 0, nil)
+}
+
+func Test_WriteZeroes(t *testing.T) {
+	dev := &zeroDevice{memDevice: memDevice{data: bytes.Repeat([]byte{1}, 4096)}}
+	tc, _, _ := connect(t, dev, "", false)
+	defer tc.c.Close()
+
+	tc.request(cmdWriteZeroes, 0, 1, 0, 8, nil)
+	if errno := tc.simpleReply(1); errno != 0 {
+		t.Fatalf("Write zeroes failed: %d", errno)
+	}
+	tc.request(cmdWriteZeroes, cmdFlagNoHole, 2, 8, 8, nil)
+	if errno := tc.simpleReply(2); errno != 0 {
+		t.Fatalf("Write zeroes failed: %d", errno)
+	}
+	if !bytes.Equal(dev.data[:16], make([]byte, 16)) || dev.data[16] != 1 {
+		t.Errorf("Wrong data zeroed, got %v", dev.data[:17])
+	}
+	if len(dev.zeroFlags) != 2 || dev.zeroFlags[0] != 0 || dev.zeroFlags[1] != writeZeroesThickProvision {
+		t.Errorf("Wrong write zeroes flags, got %v", dev.zeroFlags)
+	}
+	tc.request(cmdDisc, 0, 3, 0, 0, nil)
+}
+
+func Test_StructuredRead(t *testing.T) {
+	dev := &memDevice{data: []byte("test_structured_read")}
+	tc, _, _ := connect(t, dev, "test", true)
+	defer tc.c.Close()
+
+	tc.request(cmdRead, 0, 1, 5, 10, nil)
+	var magic uint32
+	var flags, typ uint16
+	var handle, offset uint64
+	var length uint32
+	tc.read(&magic, &flags, &typ, &handle, &length, &offset)
+	if magic != structReplyMagic || flags != replyFlagDone || typ != replyTypeOffsetData || handle != 1 || length != 18 || offset != 5 {
+		t.Fatalf("Wrong structured reply %#x %d %d %d %d %d", magic, flags, typ, handle, length, offset)
+	}
+	data := make([]byte, 10)
+	tc.read(data)
+	if string(data) != "structured" {
+		t.Errorf("Wrong read, expected structured, got %s", data)
+	}
+	tc.request(cmdDisc, 0, 2, 0, 0, nil)
+}
+
+func Test_ReadOnly(t *testing.T) {
+	dev := &memDevice{data: make([]byte, 4096), readOnly: true}
+	tc, _, flags := connect(t, dev, "test", false)
+	defer tc.c.Close()
+	if flags&flagReadOnly == 0 {
+		t.Errorf("Export should be read only, got flags %#x", flags)
+	}
+	tc.request(cmdWrite, 0, 1, 0, 4, []byte("test"))
+	if errno := tc.simpleReply(1); errno != errPerm {
+		t.Errorf("Write should fail with EPERM, got %d", errno)
+	}
+	tc.request(cmdDisc, 0, 2, 0, 0, nil)
+	if _, err := tc.c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection should be closed, got %v", err)
+	}
+}
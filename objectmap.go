@@ -0,0 +1,217 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <time.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+
+extern int goProgressCB(uint64_t, uint64_t, void *);
+
+static int goRebuildObjectMap(rbd_image_t image, uintptr_t handle) {
+   return rbd_rebuild_object_map(image, goProgressCB, (void *)handle);
+}
+*/
+import "C"
+import "context"
+import "fmt"
+import "runtime/cgo"
+import "strings"
+import "unsafe"
+import "time"
+
+// Flags of an image reported by Flags.
+const (
+	// FlagObjectMapInvalid is set when the object map must be rebuilt.
+	FlagObjectMapInvalid uint64 = C.RBD_FLAG_OBJECT_MAP_INVALID
+	// FlagFastDiffInvalid is set when the fast-diff data must be rebuilt.
+	FlagFastDiffInvalid uint64 = C.RBD_FLAG_FAST_DIFF_INVALID
+)
+
+// Flags gets the flags of the image.
+func (img *Image) Flags() (uint64, error) {
+	return img.FlagsContext(context.Background())
+}
+
+// FlagsContext is Flags passing ctx to the observer.
+func (img *Image) FlagsContext(ctx context.Context) (_ uint64, err error) {
+	defer img.observe(ctx, "flags", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
+	var flagsC C.uint64_t
+	retC := C.rbd_get_flags(img.getC(), &flagsC)
+	if retC < 0 {
+		return 0, &cError{fmt.Sprintf("Cannot get flags of image %s", img.name), 0, retC}
+	}
+	return uint64(flagsC), nil
+}
+
+// RebuildObjectMap rebuilds the object map of the image, clearing
+// FlagObjectMapInvalid and FlagFastDiffInvalid.  The progress is reported
+// to progress if it is not nil.
+func (img *Image) RebuildObjectMap(progress ProgressFunc) error {
+	return img.RebuildObjectMapContext(context.Background(), progress)
+}
+
+// RebuildObjectMapContext is RebuildObjectMap passing ctx to the observer.
+func (img *Image) RebuildObjectMapContext(ctx context.Context, progress ProgressFunc) (err error) {
+	defer img.observe(ctx, "rebuild_object_map", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	return img.withProgress(progress, func(handle C.uintptr_t) C.int {
+		return C.goRebuildObjectMap(img.getC(), handle)
+	}, "Cannot rebuild object map of image %s")
+}
+
+// withProgress calls op with a handle to give to goProgressCB.  The error
+// returned by progress, if any, takes precedence over the one of op.
+func (img *Image) withProgress(f ProgressFunc, op func(C.uintptr_t) C.int, msg string) error {
+	p := &progress{f: f}
+	handle := cgo.NewHandle(p)
+	defer handle.Delete()
+	retC := op(C.uintptr_t(handle))
+	if p.err != nil {
+		return p.err
+	}
+	if retC < 0 {
+		return &cError{fmt.Sprintf(msg, img.name), 0, retC}
+	}
+	return nil
+}
+
+// ObjectMapDiscrepancy is a data object whose existence disagrees with the
+// object map.
+type ObjectMapDiscrepancy struct {
+	ObjectNo uint64
+	Object   string
+	// InMap tells whether the object map says the object exists.
+	InMap bool
+	// Exists tells whether the object actually exists.
+	Exists bool
+}
+
+// objectName returns the name of the data object objectNo of an image.
+func objectName(prefix string, oldFormat bool, objectNo uint64) string {
+	if oldFormat {
+		return fmt.Sprintf("%s.%012x", prefix, objectNo)
+	}
+	return fmt.Sprintf("%s.%016x", prefix, objectNo)
+}
+
+// objectExists tells whether the object name exists in the pool of r.
+func (r *Rbd) objectExists(ctx context.Context, name string) (_ bool, err error) {
+	defer r.observe(ctx, "stat_object", "", time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return false, err
+	}
+	defer r.unlock()
+	nameC := C.CString(name)
+	defer C.free(unsafe.Pointer(nameC))
+	var sizeC C.uint64_t
+	var mtimeC C.time_t
+	retC := C.rados_stat(r.GetHandle(), nameC, &sizeC, &mtimeC)
+	if retC == -C.ENOENT {
+		return false, nil
+	}
+	if retC < 0 {
+		return false, &cError{fmt.Sprintf("Cannot stat object %s in pool %s", name, r.PoolName), 0, retC}
+	}
+	return true, nil
+}
+
+// CheckObjectMap compares the object map of img with the existence of its
+// data objects, which must be in the pool of r, and returns the objects
+// they disagree on.  It checks the image itself, not a snapshot, and
+// expects no concurrent writes.  The object map is read through a fast
+// diff, so the image must have the fast-diff feature and its object map
+// must not be flagged as invalid.
+func CheckObjectMap(ctx context.Context, r *Rbd, img *Image) ([]ObjectMapDiscrepancy, error) {
+	if img.wantSnapshot {
+		return nil, fmt.Errorf("Cannot check object map of image %s at snapshot %s", img.name, img.snapshot)
+	}
+	features, err := img.FeaturesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if features&ObjectMapMask == 0 {
+		return nil, fmt.Errorf("Image %s has no object map", img.name)
+	}
+	// Without fast-diff, or with an invalid object map, the diff reports
+	// the existence of the objects instead of the object map.
+	if features&FastDiffMask == 0 {
+		return nil, fmt.Errorf("Cannot check object map of image %s without fast-diff", img.name)
+	}
+	flags, err := img.FlagsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if flags&(FlagObjectMapInvalid|FlagFastDiffInvalid) != 0 {
+		return nil, fmt.Errorf("Cannot check invalid object map of image %s, it must be rebuilt", img.name)
+	}
+	info, err := img.StatContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stripeUnit, err := img.StripeUnitContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stripeCount, err := img.StripeCountContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	objectSize := info["obj_size"].(uint64)
+	if stripeCount > 1 && stripeUnit != objectSize {
+		return nil, fmt.Errorf("Cannot check object map of image %s using fancy striping", img.name)
+	}
+	oldFormat, err := img.OldFormatContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size, err := img.SizeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A whole object fast diff from the creation of the image reports the
+	// objects flagged as existing in the object map.
+	inMap := make(map[uint64]bool)
+	mapped := func(e Extent) error {
+		if !e.Exists {
+			return nil
+		}
+		for objectNo := e.Offset / objectSize; objectNo*objectSize < e.Offset+e.Length; objectNo++ {
+			inMap[objectNo] = true
+		}
+		return nil
+	}
+	if err := img.DiffIterate2(ctx, "", 0, size, false, true, mapped); err != nil {
+		return nil, err
+	}
+
+	prefix := info["block_name_prefix"].(string)
+	if i := strings.IndexByte(prefix, 0); i >= 0 {
+		prefix = prefix[:i]
+	}
+	var res []ObjectMapDiscrepancy
+	for objectNo := uint64(0); objectNo < info["num_objs"].(uint64); objectNo++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := objectName(prefix, oldFormat, objectNo)
+		exists, err := r.objectExists(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if exists != inMap[objectNo] {
+			res = append(res, ObjectMapDiscrepancy{objectNo, name, inMap[objectNo], exists})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,102 @@
+package rbd
+
+import (
+	"context"
+	"time"
+)
+
+// Operation describes a librbd call made by an Image or a Rbd.
+type Operation struct {
+	// Op is the name of the operation, like "read" or "create_snap".
+	Op string
+	// Context is the context given to the Context variant of the method
+	// making the call, context.Background() otherwise.
+	Context  context.Context
+	Pool     string
+	Image    string
+	Snapshot string
+	// Offset and Length are the range of the I/O operations.
+	Offset int64
+	Length int
+	// Bytes is the number of bytes transferred by I/O operations.
+	Bytes    int
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// Observer is notified of every librbd call once it returns.  It must be
+// safe for concurrent use.
+type Observer interface {
+	Observe(o Operation)
+}
+
+func (r *Rbd) setObserver(o Observer) error {
+	r.observer = o
+	return nil
+}
+
+// Observe is a configuration option for Rbd.  The operations of the Rbd
+// and of the images opened through it are reported to o.
+func Observe(o Observer) func(*Rbd) error {
+	return func(r *Rbd) error {
+		return r.setObserver(o)
+	}
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) Observe(o Operation) {
+	for _, observer := range m {
+		observer.Observe(o)
+	}
+}
+
+// MultiObserver returns an observer reporting the operations to all the
+// observers, like metrics and traces.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+// observe reports o, started at start.  It is meant to be deferred so that
+// n and err hold the results of the operation.
+func observe(observer Observer, o Operation, n *int, err *error) {
+	if observer == nil {
+		return
+	}
+	o.Duration = time.Since(o.Start)
+	o.Err = *err
+	if n != nil && *n > 0 {
+		o.Bytes = *n
+	}
+	observer.Observe(o)
+}
+
+func (img *Image) operation(ctx context.Context, op string, start time.Time) Operation {
+	o := Operation{Op: op, Context: ctx, Pool: img.pool, Image: img.name, Start: start}
+	if img.wantSnapshot {
+		o.Snapshot = img.snapshot
+	}
+	return o
+}
+
+func (img *Image) observe(ctx context.Context, op string, start time.Time, n *int, err *error) {
+	if img.observer == nil {
+		return
+	}
+	observe(img.observer, img.operation(ctx, op, start), n, err)
+}
+
+// observeIO reports an I/O operation on length bytes at offset.
+func (img *Image) observeIO(ctx context.Context, op string, offset int64, length int, start time.Time, n *int, err *error) {
+	if img.observer == nil {
+		return
+	}
+	o := img.operation(ctx, op, start)
+	o.Offset, o.Length = offset, length
+	observe(img.observer, o, n, err)
+}
+
+func (r *Rbd) observe(ctx context.Context, op string, image string, start time.Time, err *error) {
+	observe(r.observer, Operation{Op: op, Context: ctx, Pool: r.PoolName, Image: image, Start: start}, nil, err)
+}
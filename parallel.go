@@ -0,0 +1,176 @@
+package rbd
+
+import (
+	"io"
+	"sync"
+)
+
+// ParallelReader reads a range of an image with concurrent workers and
+// returns the data in order.  The range is split in chunks aligned on the
+// objects of the image, so that each read hits as few objects as
+// possible.  At most one chunk per worker is read ahead.
+type ParallelReader struct {
+	// pending holds the results of the chunks, in the order of the
+	// range.
+	pending chan chan chunkResult
+	done    chan struct{}
+	pool    *BufferPool
+	wg      sync.WaitGroup
+
+	buf       *[]byte
+	data      []byte
+	err       error
+	closeOnce sync.Once
+}
+
+type readJob struct {
+	offset int64
+	length int
+	res    chan chunkResult
+}
+
+type chunkResult struct {
+	buf *[]byte
+	n   int
+	err error
+}
+
+// readChunkSize returns the size of the chunks read by a ParallelReader:
+// an object, or a full stripe when the image uses fancy striping.
+func readChunkSize(img *Image) (uint64, error) {
+	info, err := img.Stat()
+	if err != nil {
+		return 0, err
+	}
+	objectSize := info["obj_size"].(uint64)
+	stripeUnit, err := img.StripeUnit()
+	if err != nil {
+		return 0, err
+	}
+	stripeCount, err := img.StripeCount()
+	if err != nil {
+		return 0, err
+	}
+	if stripeCount > 1 && stripeUnit != objectSize {
+		return stripeUnit * stripeCount, nil
+	}
+	return objectSize, nil
+}
+
+// NewParallelReader returns a reader of length bytes at offset of img,
+// read by workers goroutines.  The reader must be closed.
+func NewParallelReader(img *Image, offset uint64, length uint64, workers int) (*ParallelReader, error) {
+	chunkSize, err := readChunkSize(img)
+	if err != nil {
+		return nil, err
+	}
+	return newParallelReader(img, int64(offset), int64(length), int(chunkSize), workers), nil
+}
+
+func newParallelReader(src io.ReaderAt, offset int64, length int64, chunkSize int, workers int) *ParallelReader {
+	if workers < 1 {
+		workers = 1
+	}
+	pr := &ParallelReader{
+		pending: make(chan chan chunkResult, workers),
+		done:    make(chan struct{}),
+		pool:    NewBufferPool(chunkSize),
+	}
+	jobs := make(chan readJob)
+	pr.wg.Add(workers + 1)
+	for i := 0; i < workers; i++ {
+		go pr.work(src, jobs)
+	}
+	go pr.dispatch(jobs, offset, offset+length, int64(chunkSize))
+	return pr
+}
+
+// dispatch splits [offset, end) in chunks given to the workers.
+func (pr *ParallelReader) dispatch(jobs chan<- readJob, offset int64, end int64, chunkSize int64) {
+	defer pr.wg.Done()
+	defer close(pr.pending)
+	defer close(jobs)
+	for offset < end {
+		next := (offset/chunkSize + 1) * chunkSize
+		if next > end {
+			next = end
+		}
+		res := make(chan chunkResult, 1)
+		select {
+		case pr.pending <- res:
+		case <-pr.done:
+			return
+		}
+		select {
+		case jobs <- readJob{offset, int(next - offset), res}:
+		case <-pr.done:
+			res <- chunkResult{err: ErrClosed}
+			return
+		}
+		offset = next
+	}
+}
+
+func (pr *ParallelReader) work(src io.ReaderAt, jobs <-chan readJob) {
+	defer pr.wg.Done()
+	for job := range jobs {
+		buf := pr.pool.Get()
+		n, err := src.ReadAt((*buf)[:job.length], job.offset)
+		if err == io.EOF && n == job.length {
+			err = nil
+		}
+		job.res <- chunkResult{buf, n, err}
+	}
+}
+
+// Read implements the io.Reader interface.
+func (pr *ParallelReader) Read(p []byte) (int, error) {
+	for len(pr.data) == 0 {
+		if pr.buf != nil {
+			pr.pool.Put(pr.buf)
+			pr.buf = nil
+		}
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		res, ok := <-pr.pending
+		if !ok {
+			pr.err = io.EOF
+			select {
+			case <-pr.done:
+				pr.err = ErrClosed
+			default:
+			}
+			continue
+		}
+		r := <-res
+		pr.buf, pr.data, pr.err = r.buf, nil, r.err
+		if r.buf != nil {
+			pr.data = (*r.buf)[:r.n]
+		}
+	}
+	n := copy(p, pr.data)
+	pr.data = pr.data[n:]
+	return n, nil
+}
+
+// Close stops the workers and waits for them.  Reading after Close fails
+// with ErrClosed.
+func (pr *ParallelReader) Close() error {
+	pr.closeOnce.Do(func() {
+		close(pr.done)
+		pr.wg.Wait()
+		for res := range pr.pending {
+			if r := <-res; r.buf != nil {
+				pr.pool.Put(r.buf)
+			}
+		}
+		if pr.buf != nil {
+			pr.pool.Put(pr.buf)
+			pr.buf = nil
+		}
+		pr.data = nil
+		pr.err = ErrClosed
+	})
+	return nil
+}
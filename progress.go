@@ -0,0 +1,32 @@
+package rbd
+
+/*
+#include <stdint.h>
+#include <errno.h>
+*/
+import "C"
+import "runtime/cgo"
+import "unsafe"
+
+// ProgressFunc is called by long running operations with the amount of
+// work done out of total.  Returning an error cancels the operation.
+type ProgressFunc func(offset uint64, total uint64) error
+
+// progress is the state shared with goProgressCB through a cgo.Handle.
+type progress struct {
+	f   ProgressFunc
+	err error
+}
+
+//export goProgressCB
+func goProgressCB(offset C.uint64_t, total C.uint64_t, userdata unsafe.Pointer) C.int {
+	p := cgo.Handle(uintptr(userdata)).Value().(*progress)
+	if p.f == nil {
+		return 0
+	}
+	if err := p.f(uint64(offset), uint64(total)); err != nil {
+		p.err = err
+		return -C.ECANCELED
+	}
+	return 0
+}
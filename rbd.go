@@ -13,6 +13,10 @@ import "C"
 import "fmt"
 import "unsafe"
 import "bytes"
+import "runtime"
+import "sync"
+import "time"
+import "context"
 
 type Config struct {
 	oldFormat   bool
@@ -36,17 +40,40 @@ type IoCtxGetter interface {
 }
 
 func (r *Rbd) IoCtxGet() (uintptr, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0, ErrClosed
+	}
 	return r.ctx, nil
 }
 
 type Rbd struct {
+	mu       sync.RWMutex
+	closed   bool
+	openedAt string
+	rados    IoCtxCreateDestroyer
 	ctx      uintptr // holds a C.rados_ioctx_t
 	PoolName string
+	observer Observer
 }
 
-func NewRbd(rados IoCtxCreateDestroyer, poolName string) (*Rbd, error) {
-	ctx, _ := rados.IoCtxCreate(poolName)
-	return &Rbd{ctx, poolName}, nil
+// NewRbd opens the pool poolName.  The Rbd must be closed to destroy the
+// ioctx created with rados.
+func NewRbd(rados IoCtxCreateDestroyer, poolName string, options ...func(*Rbd) error) (*Rbd, error) {
+	r := &Rbd{rados: rados, openedAt: caller(), PoolName: poolName}
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return nil, err
+		}
+	}
+	ctx, err := rados.IoCtxCreate(poolName)
+	if err != nil {
+		return nil, err
+	}
+	r.ctx = ctx
+	runtime.SetFinalizer(r, leakedRbd)
+	return r, nil
 }
 
 func (c *Config) setOldFormat() error {
@@ -82,6 +109,16 @@ func (r *Rbd) GetHandle() C.rados_ioctx_t {
 }
 
 func (r *Rbd) Create(name string, size uint64, options ...func(*Config) error) error {
+	return r.CreateContext(context.Background(), name, size, options...)
+}
+
+// CreateContext is Create passing ctx to the observer.
+func (r *Rbd) CreateContext(ctx context.Context, name string, size uint64, options ...func(*Config) error) (err error) {
+	defer r.observe(ctx, "create", name, time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
 	// , order uint, old_format bool, features byte, stripe_unit int, stripe_count int) error {
 	var retC C.int
 	nameC := C.CString(name)
@@ -125,6 +162,22 @@ func (r *Rbd) Create(name string, size uint64, options ...func(*Config) error) e
 }
 
 func (r *Rbd) Clone(pName string, pSnapName string, rbdChild *Rbd, cName string, options ...func(*Config) error) error {
+	return r.CloneContext(context.Background(), pName, pSnapName, rbdChild, cName, options...)
+}
+
+// CloneContext is Clone passing ctx to the observer.
+func (r *Rbd) CloneContext(ctx context.Context, pName string, pSnapName string, rbdChild *Rbd, cName string, options ...func(*Config) error) (err error) {
+	defer r.observe(ctx, "clone", pName, time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
+	if rbdChild != r {
+		if err := rbdChild.lock(); err != nil {
+			return err
+		}
+		defer rbdChild.unlock()
+	}
 	pNameC := C.CString(pName)
 	defer C.free(unsafe.Pointer(pNameC))
 	pSnapNameC := C.CString(pSnapName)
@@ -150,6 +203,16 @@ func (r *Rbd) Clone(pName string, pSnapName string, rbdChild *Rbd, cName string,
 
 // int rbd_remove(rados_ioctx_t io, const char *name);
 func (r *Rbd) Remove(name string) error {
+	return r.RemoveContext(context.Background(), name)
+}
+
+// RemoveContext is Remove passing ctx to the observer.
+func (r *Rbd) RemoveContext(ctx context.Context, name string) (err error) {
+	defer r.observe(ctx, "remove", name, time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
 	nameC := C.CString(name)
 	defer C.free(unsafe.Pointer(nameC))
 	if errC := C.rbd_remove((C.rados_ioctx_t)(r.ctx), nameC); errC < 0 {
@@ -160,8 +223,6 @@ func (r *Rbd) Remove(name string) error {
 
 // int rbd_list(rados_ioctx_t io, char *names, size_t *size);
 // TODO: check http://commandcenter.blogspot.com.au/2014/01/self-referential-functions-and-design.html
-//
-//
 func splitDataN(data []byte, count int) (res []string, err error) {
 	// func (*Buffer) ReadString
 	//e	buf := bytes.NewBuffer(data)
@@ -189,6 +250,16 @@ func splitData(data []byte) (res []string, err error) {
 }
 
 func (r *Rbd) List() ([]string, error) {
+	return r.ListContext(context.Background())
+}
+
+// ListContext is List passing ctx to the observer.
+func (r *Rbd) ListContext(ctx context.Context) (_ []string, err error) {
+	defer r.observe(ctx, "list", "", time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return nil, err
+	}
+	defer r.unlock()
 	sizeC := C.size_t(1)
 	var data []byte
 	data = make([]byte, int(sizeC))
@@ -220,6 +291,16 @@ retry:
 }
 
 func (r *Rbd) Rename(src string, dest string) error {
+	return r.RenameContext(context.Background(), src, dest)
+}
+
+// RenameContext is Rename passing ctx to the observer.
+func (r *Rbd) RenameContext(ctx context.Context, src string, dest string) (err error) {
+	defer r.observe(ctx, "rename", src, time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
 	errC := C.rbd_rename((C.rados_ioctx_t)(r.ctx), C.CString(src), C.CString(dest))
 	if errC != 0 {
 		return &cError{fmt.Sprintf("Cannot rename %s to %s", src, dest), 0, errC}
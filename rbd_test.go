@@ -1,9 +1,11 @@
 package rbd
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -11,25 +13,25 @@ import (
 )
 
 type rbdTest struct {
-	t        *testing.T
+	t        testing.TB
 	c        IoCtxCreateDestroyer
 	r        *Rbd
 	poolName string
 	rados    RadosPoolDestroyer
 }
 
-func checkError(t *testing.T, e error, message string, args ...interface{}) {
+func checkError(t testing.TB, e error, message string, args ...interface{}) {
 	if e != nil {
 		t.Errorf("%v : %v", e, fmt.Sprintf(message, args))
 	}
 }
-func checkFatal(t *testing.T, e error, message string, args ...interface{}) {
+func checkFatal(t testing.TB, e error, message string, args ...interface{}) {
 	if e != nil {
 		t.Fatalf("%v : %v", e, fmt.Sprintf(message, args))
 	}
 }
 
-func setupContext(t *testing.T, name string, count uint) *rbdTest {
+func setupContext(t testing.TB, name string, count uint) *rbdTest {
 	c, _ := rad.NewRados("/tmp/micro-ceph/ceph.conf")
 	c.Connect()
 	poolName := "rbd_test"
@@ -79,6 +81,62 @@ func Test_CreateRemove(t *testing.T) {
 	}
 }
 
+func Test_RbdClose(t *testing.T) {
+	rbdTest := setupContext(t, "rbd_test", 0)
+	defer rbdTest.rados.DeletePool(rbdTest.poolName)
+	checkError(t, rbdTest.r.Close(), "Problem closing the pool %s", rbdTest.poolName)
+	checkError(t, rbdTest.r.Close(), "Problem closing the pool %s twice", rbdTest.poolName)
+	if _, err := rbdTest.r.List(); err != ErrClosed {
+		t.Errorf("Wrong error listing the closed pool %s, expected %v, got %v", rbdTest.poolName, ErrClosed, err)
+	}
+	if _, err := NewImage(rbdTest.r, "image"); err != ErrClosed {
+		t.Errorf("Wrong error opening an image of the closed pool %s, expected %v, got %v", rbdTest.poolName, ErrClosed, err)
+	}
+}
+
+func Test_Conn(t *testing.T) {
+	rbdTest := setupContext(t, "rbd_test", 0)
+	defer rbdTest.rados.DeletePool(rbdTest.poolName)
+	conn, err := NewConn("ceph", "client.admin")
+	checkFatal(t, err, "Cannot create connection")
+	defer conn.Shutdown()
+	checkFatal(t, conn.ReadConfigFile("/tmp/micro-ceph/ceph.conf"), "Cannot read configuration")
+	checkFatal(t, conn.SetConfig("rbd_cache", "false"), "Cannot set configuration")
+	if _, err := NewRbd(conn, rbdTest.poolName); err == nil {
+		t.Errorf("Pool %s opened before connecting", rbdTest.poolName)
+	}
+	checkFatal(t, conn.Connect(), "Cannot connect")
+
+	r, err := NewRbd(conn, rbdTest.poolName)
+	checkFatal(t, err, "Cannot open pool %s", rbdTest.poolName)
+	device := uniqName("test_conn", 0)
+	checkFatal(t, r.Create(device, 10), "Cannot create %s", device)
+	defer rbdTest.r.Remove(device)
+	names, err := r.List()
+	checkError(t, err, "Cannot list pool %s", rbdTest.poolName)
+	if !contains(names, device) {
+		t.Errorf("Cannot find the device %s in %v", device, names)
+	}
+	checkError(t, r.Close(), "Cannot close pool %s", rbdTest.poolName)
+
+	_, err = NewRbd(conn, "missing_pool")
+	if errno, _ := Errno(err); errno != syscall.ENOENT {
+		t.Errorf("Wrong error opening a missing pool: %v", err)
+	}
+
+	// the shutdown destroys the ioctx still open, once
+	r, err = NewRbd(conn, rbdTest.poolName)
+	checkFatal(t, err, "Cannot open pool %s", rbdTest.poolName)
+	if len(conn.ioctxs) != 1 {
+		t.Errorf("Wrong ioctx tracked before the shutdown: %v", conn.ioctxs)
+	}
+	conn.Shutdown()
+	if len(conn.ioctxs) != 0 {
+		t.Errorf("Ioctx not destroyed by the shutdown: %v", conn.ioctxs)
+	}
+	checkError(t, r.Close(), "Cannot close pool %s after the shutdown", rbdTest.poolName)
+}
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -178,3 +236,56 @@ func Test_Clone(t *testing.T) {
 func Test_Overlap(t *testing.T) {
 	t.Skip("TODO")
 }
+
+func Test_PoolConfig(t *testing.T) {
+	rbdTest := setupContext(t, "rbd_test", 2)
+	if err := rbdTest.r.SetPoolConfig("rbd_cache", "false"); err != nil {
+		t.Fatalf("Cannot set configuration of pool %s: %v", rbdTest.poolName, err)
+	}
+	defer rbdTest.r.RemovePoolConfig("rbd_cache")
+	options, err := rbdTest.r.PoolConfigList()
+	checkFatal(t, err, "Cannot list configuration of pool %s", rbdTest.poolName)
+	o, ok := findConfig(options, "rbd_cache")
+	if !ok || o.Value != "false" || o.Source != ConfigSourcePool {
+		t.Errorf("Wrong configuration for pool %s, got %v", rbdTest.poolName, o)
+	}
+}
+
+type recordObserver struct {
+	ops []Operation
+}
+
+func (o *recordObserver) Observe(op Operation) {
+	o.ops = append(o.ops, op)
+}
+
+func Test_Observe(t *testing.T) {
+	c, _ := rad.NewRados("/tmp/micro-ceph/ceph.conf")
+	c.Connect()
+	o := &recordObserver{}
+	r, _ := NewRbd(c, "rbd_test", Observe(o))
+	device := uniqName("test_observe", 0)
+	if err := r.Create(device, 10); err != nil {
+		t.Fatalf("Cannot create %s: %v", device, err)
+	}
+	img, err := NewImage(r, device)
+	checkFatal(t, err, "Problem opening the image %s", device)
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, device)
+	img.WriteAtContext(ctx, []byte("test"), 0)
+	img.Close()
+	r.Remove(device)
+
+	expected := []string{"create", "open", "write", "close", "remove"}
+	if len(o.ops) != len(expected) {
+		t.Fatalf("Wrong operations observed, got %v", o.ops)
+	}
+	for i, op := range expected {
+		if o.ops[i].Op != op || o.ops[i].Pool != "rbd_test" || o.ops[i].Err != nil {
+			t.Errorf("Wrong operation, expected %s, got %+v", op, o.ops[i])
+		}
+	}
+	if o.ops[2].Bytes != 4 || o.ops[2].Image != device || o.ops[2].Length != 4 || o.ops[2].Context != ctx {
+		t.Errorf("Wrong write observed, got %+v", o.ops[2])
+	}
+}
@@ -0,0 +1,132 @@
+// Package rbdhttp gives read-only access to rbd images over HTTP.
+//
+// The handler answers:
+//
+//	GET /                   the json list of the images of the pool
+//	GET /image              the content of image
+//	GET /image@snap         the content of the snapshot snap of image
+//
+// Image content supports HEAD and Range requests, so standard HTTP clients
+// and curl --range can fetch parts of an image.  Snapshots are immutable
+// and carry an ETag derived from their id.
+package rbdhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+// Handler serves the images of a pool.
+type Handler struct {
+	r *rbd.Rbd
+}
+
+// NewHandler returns a handler serving the images of r.
+func NewHandler(r *rbd.Rbd) *Handler {
+	return &Handler{r}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	spec := strings.TrimPrefix(req.URL.Path, "/")
+	if spec == "" {
+		h.serveList(w, req)
+		return
+	}
+	if strings.Contains(spec, "/") {
+		http.NotFound(w, req)
+		return
+	}
+	h.serveImage(w, req, spec)
+}
+
+func (h *Handler) serveList(w http.ResponseWriter, req *http.Request) {
+	names, err := h.r.List()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// snapID finds the id of the snapshot snap of img.
+func snapID(img *rbd.Image, snap string) (uint64, error) {
+	snaps, err := img.ListSnaps()
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range snaps {
+		if s.Name == snap {
+			return s.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("Cannot find snapshot %s: %w", snap, syscall.ENOENT)
+}
+
+func (h *Handler) serveImage(w http.ResponseWriter, req *http.Request, spec string) {
+	name, snap := spec, ""
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		name, snap = spec[:i], spec[i+1:]
+	}
+	options := []func(*rbd.Image) error{rbd.ReadOnly}
+	if snap != "" {
+		options = append(options, rbd.SnapshotName(snap))
+	}
+	img, err := rbd.NewImage(h.r, name, options...)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer img.Close()
+	size, err := img.Size()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if snap != "" {
+		id, err := snapID(img, snap)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, name, id))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// ServeContent handles HEAD, Range, If-Range, If-None-Match and sets
+	// Content-Length.
+	http.ServeContent(w, req, name, time.Time{}, io.NewSectionReader(img, 0, int64(size)))
+}
+
+// httpError maps librbd errors to HTTP status codes.
+func httpError(w http.ResponseWriter, err error) {
+	errno, ok := rbd.Errno(err)
+	if !ok {
+		ok = errors.As(err, &errno)
+	}
+	status := http.StatusInternalServerError
+	if ok {
+		switch errno {
+		case syscall.ENOENT:
+			status = http.StatusNotFound
+		case syscall.EPERM, syscall.EACCES:
+			status = http.StatusForbidden
+		case syscall.EBUSY, syscall.ETIMEDOUT:
+			status = http.StatusServiceUnavailable
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
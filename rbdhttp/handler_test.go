@@ -0,0 +1,110 @@
+package rbdhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	rad "github.com/sathlan/libradosgo"
+	rbd "github.com/sathlan/librbdgo"
+)
+
+func setupImage(t *testing.T, prefix string, data string) (*rbd.Rbd, string) {
+	c, _ := rad.NewRados("/tmp/micro-ceph/ceph.conf")
+	c.Connect()
+	c.CreatePool("rbd_test")
+	r, _ := rbd.NewRbd(c, "rbd_test")
+	name := fmt.Sprintf("%s-%d", prefix, time.Now().Unix())
+	if err := r.Create(name, uint64(len(data)), rbd.Layering()); err != nil {
+		t.Fatalf("Cannot create image %s: %v", name, err)
+	}
+	img, err := rbd.NewImage(r, name)
+	if err != nil {
+		t.Fatalf("Cannot open image %s: %v", name, err)
+	}
+	defer img.Close()
+	img.WriteAt([]byte(data), 0)
+	if err := img.CreateSnap("snap_001"); err != nil {
+		t.Fatalf("Cannot snap %s: %v", name, err)
+	}
+	return r, name
+}
+
+func cleanImage(r *rbd.Rbd, name string) {
+	if img, err := rbd.NewImage(r, name); err == nil {
+		img.RemoveSnap("snap_001")
+		img.Close()
+	}
+	r.Remove(name)
+}
+
+func Test_Handler(t *testing.T) {
+	r, name := setupImage(t, "http_handler", "test_http_handler")
+	defer cleanImage(r, name)
+	server := httptest.NewServer(NewHandler(r))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Cannot list images: %v", err)
+	}
+	var names []string
+	json.NewDecoder(res.Body).Decode(&names)
+	res.Body.Close()
+	found := false
+	for _, n := range names {
+		found = found || n == name
+	}
+	if !found {
+		t.Errorf("Cannot find %s in %v", name, names)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/"+name+"@snap_001", nil)
+	req.Header.Set("Range", "bytes=5-8")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Cannot get range of %s: %v", name, err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || string(body) != "http" {
+		t.Errorf("Wrong range of %s, got %d %q", name, res.StatusCode, body)
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Errorf("No ETag for the snapshot of %s", name)
+	}
+
+	req, _ = http.NewRequest("HEAD", server.URL+"/"+name+"@snap_001", nil)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Cannot get head of %s: %v", name, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("Snapshot of %s should not be modified, got %d", name, res.StatusCode)
+	}
+
+	res, err = http.Head(server.URL + "/" + name)
+	if err != nil {
+		t.Fatalf("Cannot get head of %s: %v", name, err)
+	}
+	res.Body.Close()
+	if res.ContentLength != int64(len("test_http_handler")) {
+		t.Errorf("Wrong length for %s, got %d", name, res.ContentLength)
+	}
+
+	res, err = http.Get(server.URL + "/does_not_exist")
+	if err != nil {
+		t.Fatalf("Cannot get missing image: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Missing image should be not found, got %d", res.StatusCode)
+	}
+}
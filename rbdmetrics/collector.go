@@ -0,0 +1,91 @@
+// Package rbdmetrics exposes prometheus metrics about the librbd calls made
+// through the rbd package.
+//
+// A Collector is both an rbd.Observer and a prometheus.Collector:
+//
+//	c := rbdmetrics.NewCollector()
+//	prometheus.MustRegister(c)
+//	r, err := rbd.NewRbd(rados, "rbd", rbd.Observe(c))
+package rbdmetrics
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	rbd "github.com/sathlan/librbdgo"
+)
+
+// Collector records the operations it observes.
+type Collector struct {
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	bytes      *prometheus.CounterVec
+}
+
+// NewCollector returns a collector with empty metrics.
+func NewCollector() *Collector {
+	labels := []string{"op", "pool"}
+	return &Collector{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rbd",
+			Name:      "operations_total",
+			Help:      "Number of librbd operations.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rbd",
+			Name:      "operation_errors_total",
+			Help:      "Number of failed librbd operations by errno.",
+		}, append(labels, "errno")),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "rbd",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of librbd operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, labels),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rbd",
+			Name:      "bytes_total",
+			Help:      "Number of bytes read or written.",
+		}, labels),
+	}
+}
+
+// errnoLabel returns the errno of err, or "unknown" when err does not
+// come from librbd.
+func errnoLabel(err error) string {
+	if errno, ok := rbd.Errno(err); ok {
+		return strconv.Itoa(int(errno))
+	}
+	return "unknown"
+}
+
+// Observe implements the rbd.Observer interface.
+func (c *Collector) Observe(o rbd.Operation) {
+	c.operations.WithLabelValues(o.Op, o.Pool).Inc()
+	c.duration.WithLabelValues(o.Op, o.Pool).Observe(o.Duration.Seconds())
+	if o.Bytes > 0 {
+		c.bytes.WithLabelValues(o.Op, o.Pool).Add(float64(o.Bytes))
+	}
+	// reaching the end of the image is not a failure
+	if o.Err != nil && o.Err != io.EOF {
+		c.errors.WithLabelValues(o.Op, o.Pool, errnoLabel(o.Err)).Inc()
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.operations.Describe(ch)
+	c.errors.Describe(ch)
+	c.duration.Describe(ch)
+	c.bytes.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.operations.Collect(ch)
+	c.errors.Collect(ch)
+	c.duration.Collect(ch)
+	c.bytes.Collect(ch)
+}
@@ -0,0 +1,46 @@
+package rbdmetrics
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	rbd "github.com/sathlan/librbdgo"
+)
+
+func Test_Observe(t *testing.T) {
+	c := NewCollector()
+	c.Observe(rbd.Operation{Op: "read", Pool: "rbd", Bytes: 512, Duration: time.Millisecond})
+	c.Observe(rbd.Operation{Op: "read", Pool: "rbd", Bytes: 100, Duration: time.Millisecond, Err: io.EOF})
+	c.Observe(rbd.Operation{Op: "write", Pool: "rbd", Duration: time.Millisecond, Err: errors.New("failed")})
+
+	if n := testutil.ToFloat64(c.operations.WithLabelValues("read", "rbd")); n != 2 {
+		t.Errorf("Wrong number of reads, expected 2, got %v", n)
+	}
+	if n := testutil.ToFloat64(c.bytes.WithLabelValues("read", "rbd")); n != 612 {
+		t.Errorf("Wrong number of bytes read, expected 612, got %v", n)
+	}
+	for _, series := range []struct {
+		name     string
+		c        prometheus.Collector
+		expected int
+	}{
+		{"operation", c.operations, 2},
+		{"duration", c.duration, 2},
+		{"bytes", c.bytes, 1},
+		{"error", c.errors, 1},
+	} {
+		if n := testutil.CollectAndCount(series.c); n != series.expected {
+			t.Errorf("Wrong number of %s series, expected %d, got %v", series.name, series.expected, n)
+		}
+	}
+	if n := testutil.ToFloat64(c.errors.WithLabelValues("write", "rbd", "unknown")); n != 1 {
+		t.Errorf("Wrong number of write errors, expected 1, got %v", n)
+	}
+	if n := testutil.CollectAndCount(c); n != 6 {
+		t.Errorf("Wrong number of series, expected 6, got %v", n)
+	}
+}
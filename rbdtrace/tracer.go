@@ -0,0 +1,66 @@
+// Package rbdtrace emits OpenTelemetry spans for the librbd calls made
+// through the rbd package.
+//
+// An Observer creates a span for each operation it observes, as a child of
+// the span of the context given to the Context variants of the methods:
+//
+//	o := rbdtrace.NewObserver(otel.GetTracerProvider())
+//	r, err := rbd.NewRbd(rados, "rbd", rbd.Observe(o))
+//	img, err := rbd.NewImageContext(ctx, r, "image")
+//	n, err := img.ReadAtContext(ctx, buf, 0)
+package rbdtrace
+
+import (
+	"context"
+	"io"
+
+	rbd "github.com/sathlan/librbdgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/sathlan/librbdgo"
+
+// Observer turns the operations it observes into spans.
+type Observer struct {
+	tracer trace.Tracer
+}
+
+// NewObserver returns an observer creating its spans with tp.
+func NewObserver(tp trace.TracerProvider) *Observer {
+	return &Observer{tp.Tracer(tracerName)}
+}
+
+// Observe implements the rbd.Observer interface.  The span is named after
+// the operation, like rbd.read, and spans the duration of the call.
+func (o *Observer) Observe(op rbd.Operation) {
+	ctx := op.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	attrs := []attribute.KeyValue{attribute.String("rbd.pool", op.Pool)}
+	if op.Image != "" {
+		attrs = append(attrs, attribute.String("rbd.image", op.Image))
+	}
+	if op.Snapshot != "" {
+		attrs = append(attrs, attribute.String("rbd.snapshot", op.Snapshot))
+	}
+	if op.Length != 0 {
+		attrs = append(attrs, attribute.Int64("rbd.offset", op.Offset), attribute.Int("rbd.length", op.Length))
+	}
+	_, span := o.tracer.Start(ctx, "rbd."+op.Op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(op.Start),
+		trace.WithAttributes(attrs...),
+	)
+	// reaching the end of the image is not a failure
+	if op.Err != nil && op.Err != io.EOF {
+		if errno, ok := rbd.Errno(op.Err); ok {
+			span.SetAttributes(attribute.Int("rbd.errno", int(errno)))
+		}
+		span.RecordError(op.Err)
+		span.SetStatus(codes.Error, op.Err.Error())
+	}
+	span.End(trace.WithTimestamp(op.Start.Add(op.Duration)))
+}
@@ -0,0 +1,52 @@
+package rbdtrace
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_Observe(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	o := NewObserver(tp)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "boot")
+	start := time.Now()
+	o.Observe(rbd.Operation{
+		Op: "read", Context: ctx, Pool: "rbd", Image: "vm", Snapshot: "golden",
+		Offset: 4096, Length: 512, Bytes: 512, Start: start, Duration: time.Millisecond,
+	})
+	o.Observe(rbd.Operation{Op: "parent_info", Pool: "rbd", Image: "vm", Start: start, Err: errors.New("failed")})
+	parent.End()
+
+	spans := sr.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Wrong number of spans, expected 3, got %d", len(spans))
+	}
+	read := spans[0]
+	if read.Name() != "rbd.read" || read.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Wrong read span: %s, parent %v", read.Name(), read.Parent())
+	}
+	if read.EndTime().Sub(read.StartTime()) != time.Millisecond || !read.StartTime().Equal(start) {
+		t.Errorf("Wrong read span times: %v to %v", read.StartTime(), read.EndTime())
+	}
+	attrs := make(map[string]string)
+	for _, kv := range read.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	expected := map[string]string{"rbd.pool": "rbd", "rbd.image": "vm", "rbd.snapshot": "golden", "rbd.offset": "4096", "rbd.length": "512"}
+	for k, v := range expected {
+		if attrs[k] != v {
+			t.Errorf("Wrong attribute %s, expected %s, got %s", k, v, attrs[k])
+		}
+	}
+	if failed := spans[1]; failed.Parent().IsValid() || failed.Status().Description != "failed" {
+		t.Errorf("Wrong failed span: parent %v, status %v", failed.Parent(), failed.Status())
+	}
+}
@@ -0,0 +1,462 @@
+// Package replicate asynchronously replicates rbd images to another pool,
+// possibly of another cluster, using snapshot diffs.
+//
+// Each replication snapshots the source image, copies the extents changed
+// since the last replicated snapshot to the destination image and takes
+// the same snapshot there.  The replication snapshots are named after a
+// prefix and their UTC creation time, and the last one present on both
+// images is where the next replication starts from.
+//
+// The progress of a replication is saved in the metadata of the
+// destination image, so that a replication interrupted by a crash resumes
+// where it stopped.
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+// Metadata keys of the destination image holding the state of the
+// replication in progress.
+const (
+	pendingKey = "replicate.snapshot"
+	offsetKey  = "replicate.offset"
+)
+
+const timeFormat = "20060102T150405.000000000Z"
+
+// copyBufferSize is the size of the buffer used to copy the extents.
+const copyBufferSize = 4 * 1024 * 1024
+
+// Replicator replicates images of Source to Dest.
+type Replicator struct {
+	Source *rbd.Rbd
+	Dest   *rbd.Rbd
+	// Images are the names of the images to replicate.  The destination
+	// images have the same names.
+	Images []string
+	// Prefix of the replication snapshots, "repl-" when empty.
+	Prefix string
+	// Keep is the number of replication snapshots kept on both sides,
+	// at least 1.
+	Keep int
+	// Interval between the replications started by Run.
+	Interval time.Duration
+	// Checkpoint is the number of bytes copied between two saves of the
+	// progress, 64 MiB when zero.
+	Checkpoint uint64
+	// Reader, when set, wraps the source snapshots read by the
+	// replications, like rbd.Throttle does to limit their I/O.
+	Reader func(*rbd.Image) io.ReaderAt
+	// CreateOptions are passed to Rbd.Create for the destination images
+	// that do not exist.
+	CreateOptions []func(*rbd.Config) error
+	// ErrorLog receives the errors of the replications started by Run.
+	// Nothing is logged when it is nil.
+	ErrorLog *log.Logger
+}
+
+func (rp *Replicator) prefix() string {
+	if rp.Prefix == "" {
+		return "repl-"
+	}
+	return rp.Prefix
+}
+
+func (rp *Replicator) keep() int {
+	if rp.Keep < 1 {
+		return 1
+	}
+	return rp.Keep
+}
+
+func (rp *Replicator) checkpoint() uint64 {
+	if rp.Checkpoint == 0 {
+		return 64 * 1024 * 1024
+	}
+	return rp.Checkpoint
+}
+
+// Run replicates all the images at each interval until ctx is done.
+func (rp *Replicator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(rp.Interval)
+	defer ticker.Stop()
+	for {
+		if err := rp.RunOnce(ctx); err != nil && rp.ErrorLog != nil {
+			rp.ErrorLog.Printf("replicate: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce replicates all the images once.  It carries on after a failure
+// on an image and returns the first error.
+func (rp *Replicator) RunOnce(ctx context.Context) error {
+	var firstErr error
+	for _, name := range rp.Images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := rp.Replicate(ctx, name); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return firstErr
+}
+
+func isNotFound(err error) bool {
+	errno, ok := rbd.Errno(err)
+	return ok && errno == syscall.ENOENT
+}
+
+// replicationSnaps returns the names of the replication snapshots of img,
+// from the oldest to the most recent.
+func replicationSnaps(img *rbd.Image, prefix string) ([]string, error) {
+	snaps, err := img.ListSnaps()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range snaps {
+		if strings.HasPrefix(s.Name, prefix) {
+			names = append(names, s.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lastCommon returns the most recent snapshot of dst also in src, or ""
+// if there is none.
+func lastCommon(src []string, dst []string) string {
+	for i := len(dst) - 1; i >= 0; i-- {
+		if contains(src, dst[i]) {
+			return dst[i]
+		}
+	}
+	return ""
+}
+
+// state is the progress of a replication.
+type state struct {
+	snapshot string
+	offset   uint64
+}
+
+func loadState(img *rbd.Image) (state, error) {
+	snapshot, err := img.GetMetadata(pendingKey)
+	if isNotFound(err) {
+		return state{}, nil
+	}
+	if err != nil {
+		return state{}, err
+	}
+	offset, err := img.GetMetadata(offsetKey)
+	if err != nil && !isNotFound(err) {
+		return state{}, err
+	}
+	s := state{snapshot: snapshot}
+	if offset != "" {
+		if s.offset, err = strconv.ParseUint(offset, 10, 64); err != nil {
+			return state{}, fmt.Errorf("Invalid replication offset %q: %v", offset, err)
+		}
+	}
+	return s, nil
+}
+
+func saveState(img *rbd.Image, s state) error {
+	if err := img.SetMetadata(pendingKey, s.snapshot); err != nil {
+		return err
+	}
+	return img.SetMetadata(offsetKey, strconv.FormatUint(s.offset, 10))
+}
+
+func clearState(img *rbd.Image) error {
+	for _, key := range []string{offsetKey, pendingKey} {
+		if err := img.RemoveMetadata(key); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// openDest opens the destination image name, creating it if needed.
+func (rp *Replicator) openDest(name string, size uint64) (*rbd.Image, error) {
+	img, err := rbd.NewImage(rp.Dest, name)
+	if !isNotFound(err) {
+		return img, err
+	}
+	if err := rp.Dest.Create(name, size, rp.CreateOptions...); err != nil {
+		return nil, err
+	}
+	return rbd.NewImage(rp.Dest, name)
+}
+
+// Replicate replicates the image name once.
+func (rp *Replicator) Replicate(ctx context.Context, name string) error {
+	src, err := rbd.NewImage(rp.Source, name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	size, err := src.Size()
+	if err != nil {
+		return err
+	}
+	dst, err := rp.openDest(name, size)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if dst != nil {
+			dst.Close()
+		}
+	}()
+
+	srcSnaps, err := replicationSnaps(src, rp.prefix())
+	if err != nil {
+		return err
+	}
+	dstSnaps, err := replicationSnaps(dst, rp.prefix())
+	if err != nil {
+		return err
+	}
+	from := lastCommon(srcSnaps, dstSnaps)
+	s, err := loadState(dst)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case s.snapshot != "" && contains(dstSnaps, s.snapshot):
+		// The replication completed before its state was cleared.
+		if err := clearState(dst); err != nil {
+			return err
+		}
+		from, s = s.snapshot, state{}
+	case s.snapshot != "" && !contains(srcSnaps, s.snapshot):
+		// The replication in progress cannot be resumed, undo its
+		// writes.
+		if dst, err = rp.reset(dst, name, from, size); err != nil {
+			return err
+		}
+		s = state{}
+	}
+	if s.snapshot == "" {
+		s.snapshot = rp.prefix() + time.Now().UTC().Format(timeFormat)
+		if err := src.CreateSnap(s.snapshot); err != nil {
+			return err
+		}
+		if err := saveState(dst, s); err != nil {
+			return err
+		}
+		srcSnaps = append(srcSnaps, s.snapshot)
+	}
+
+	if err := rp.copy(ctx, dst, name, from, s); err != nil {
+		return err
+	}
+	if err := dst.CreateSnap(s.snapshot); err != nil {
+		return err
+	}
+	if err := clearState(dst); err != nil {
+		return err
+	}
+	dstSnaps = append(dstSnaps, s.snapshot)
+	return rp.collect(src, dst, srcSnaps, dstSnaps)
+}
+
+// reset discards the writes made to dst since the snapshot from, or
+// recreates dst if there is no such snapshot.
+func (rp *Replicator) reset(dst *rbd.Image, name string, from string, size uint64) (*rbd.Image, error) {
+	if from != "" {
+		return dst, dst.RollbackToSnap(from)
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	if err := rp.Dest.Remove(name); err != nil {
+		return nil, err
+	}
+	return rp.openDest(name, size)
+}
+
+// copy copies to dst the extents of the snapshot s.snapshot of the source
+// image changed since from, starting at s.offset.
+func (rp *Replicator) copy(ctx context.Context, dst *rbd.Image, name string, from string, s state) error {
+	snap, err := rbd.NewImage(rp.Source, name, rbd.ReadOnly, rbd.SnapshotName(s.snapshot))
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	size, err := snap.Size()
+	if err != nil {
+		return err
+	}
+	dstSize, err := dst.Size()
+	if err != nil {
+		return err
+	}
+	if dstSize != size {
+		if err := dst.Resize(size); err != nil {
+			return err
+		}
+	}
+	if s.offset >= size {
+		return dst.Flush()
+	}
+
+	extents, err := snap.ChangedExtents(ctx, from, s.offset, size-s.offset, true, false)
+	if err != nil {
+		return err
+	}
+	save := func(offset uint64) error {
+		if err := dst.Flush(); err != nil {
+			return err
+		}
+		s.offset = offset
+		return saveState(dst, s)
+	}
+	var src io.ReaderAt = snap
+	if rp.Reader != nil {
+		src = rp.Reader(snap)
+	}
+	if err := copyExtents(ctx, dst, src, extents, s.offset, rp.checkpoint(), save); err != nil {
+		return err
+	}
+	return dst.Flush()
+}
+
+// destination is the image the extents are copied to.
+type destination interface {
+	io.WriterAt
+	Discard(offset int, length int) error
+}
+
+// copyExtents copies the extents of src to dst, or discards them if they
+// do not exist, from offset on.  Each time checkpoint bytes were copied,
+// save is called with the offset reached.
+func copyExtents(ctx context.Context, dst destination, src io.ReaderAt, extents []rbd.Extent, offset uint64, checkpoint uint64, save func(uint64) error) error {
+	buf := make([]byte, copyBufferSize)
+	var copied uint64
+	for _, e := range extents {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if e.Offset+e.Length <= offset {
+			continue
+		}
+		if e.Offset < offset {
+			// The extent started before the resumed offset.
+			e.Length -= offset - e.Offset
+			e.Offset = offset
+		}
+		end := e.Offset + e.Length
+		if !e.Exists {
+			if err := dst.Discard(int(e.Offset), int(e.Length)); err != nil {
+				return err
+			}
+			copied += e.Length
+			if copied >= checkpoint {
+				copied = 0
+				if err := save(end); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for off := e.Offset; off < end; {
+			chunk := buf
+			if uint64(len(chunk)) > end-off {
+				chunk = chunk[:end-off]
+			}
+			n, err := src.ReadAt(chunk, int64(off))
+			if err != nil && !(err == io.EOF && n == len(chunk)) {
+				return err
+			}
+			if _, err := dst.WriteAt(chunk[:n], int64(off)); err != nil {
+				return err
+			}
+			off += uint64(n)
+			copied += uint64(n)
+			if copied >= checkpoint {
+				copied = 0
+				if err := save(off); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// obsolete returns the snapshots of snaps to remove: the ones older than
+// the keep most recent snapshots in common, and the ones of abandoned
+// replications.
+func obsolete(snaps []string, common []string, keep int) []string {
+	var kept []string
+	if len(common) > keep {
+		kept = common[len(common)-keep:]
+	} else {
+		kept = common
+	}
+	var res []string
+	for _, name := range snaps {
+		if !contains(kept, name) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// collect removes the obsolete replication snapshots of src and dst.
+// Protected snapshots are kept.
+func (rp *Replicator) collect(src *rbd.Image, dst *rbd.Image, srcSnaps []string, dstSnaps []string) error {
+	var common []string
+	for _, name := range dstSnaps {
+		if contains(srcSnaps, name) {
+			common = append(common, name)
+		}
+	}
+	for _, side := range []struct {
+		img   *rbd.Image
+		snaps []string
+	}{{src, srcSnaps}, {dst, dstSnaps}} {
+		for _, name := range obsolete(side.snaps, common, rp.keep()) {
+			protected, err := side.img.IsProtectedSnap(name)
+			if err != nil {
+				return err
+			}
+			if protected {
+				continue
+			}
+			if err := side.img.RemoveSnap(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
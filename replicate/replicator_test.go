@@ -0,0 +1,135 @@
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+func Test_LastCommon(t *testing.T) {
+	for _, test := range []struct {
+		src, dst []string
+		expected string
+	}{
+		{nil, nil, ""},
+		{[]string{"repl-1", "repl-2"}, nil, ""},
+		{[]string{"repl-1", "repl-2"}, []string{"repl-1"}, "repl-1"},
+		{[]string{"repl-1", "repl-2", "repl-3"}, []string{"repl-1", "repl-2"}, "repl-2"},
+		{[]string{"repl-2", "repl-3"}, []string{"repl-1", "repl-2"}, "repl-2"},
+		{[]string{"repl-3"}, []string{"repl-1", "repl-2"}, ""},
+	} {
+		if got := lastCommon(test.src, test.dst); got != test.expected {
+			t.Errorf("Wrong last common snapshot of %v and %v, expected %q, got %q", test.src, test.dst, test.expected, got)
+		}
+	}
+}
+
+func Test_Obsolete(t *testing.T) {
+	for _, test := range []struct {
+		snaps, common []string
+		keep          int
+		expected      []string
+	}{
+		{[]string{"repl-1"}, []string{"repl-1"}, 1, nil},
+		{[]string{"repl-1", "repl-2", "repl-3"}, []string{"repl-1", "repl-3"}, 1, []string{"repl-1", "repl-2"}},
+		{[]string{"repl-1", "repl-2", "repl-3"}, []string{"repl-1", "repl-2", "repl-3"}, 2, []string{"repl-1"}},
+		{[]string{"repl-1", "repl-2"}, []string{"repl-1", "repl-2"}, 5, nil},
+	} {
+		got := obsolete(test.snaps, test.common, test.keep)
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("Wrong obsolete snapshots of %v keeping %d of %v, expected %v, got %v", test.snaps, test.keep, test.common, test.expected, got)
+		}
+	}
+}
+
+// memDest is a destination image in memory.  Once failing is set, its
+// writes and discards fail.
+type memDest struct {
+	data    []byte
+	failing bool
+	// lowest is the lowest offset written or discarded.
+	lowest int64
+}
+
+var errDest = errors.New("destination failed")
+
+func (d *memDest) touch(off int64) error {
+	if d.failing {
+		return errDest
+	}
+	if off < d.lowest {
+		d.lowest = off
+	}
+	return nil
+}
+
+func (d *memDest) WriteAt(p []byte, off int64) (int, error) {
+	if err := d.touch(off); err != nil {
+		return 0, err
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memDest) Discard(offset int, length int) error {
+	if err := d.touch(int64(offset)); err != nil {
+		return err
+	}
+	for i := offset; i < offset+length; i++ {
+		d.data[i] = 0
+	}
+	return nil
+}
+
+func Test_CopyExtentsResume(t *testing.T) {
+	const kib = 1024
+	src := make([]byte, 64*kib)
+	for i := range src {
+		src[i] = byte(i%251 + 1)
+	}
+	for i := 16 * kib; i < 32*kib; i++ {
+		src[i] = 0
+	}
+	extents := []rbd.Extent{
+		{Offset: 0, Length: 16 * kib, Exists: true},
+		{Offset: 16 * kib, Length: 16 * kib, Exists: false},
+		{Offset: 32 * kib, Length: 32 * kib, Exists: true},
+	}
+	dst := &memDest{data: bytes.Repeat([]byte{0xff}, len(src))}
+
+	// the destination fails right after the first checkpoint
+	var saved uint64
+	save := func(offset uint64) error {
+		saved = offset
+		dst.failing = true
+		return nil
+	}
+	err := copyExtents(context.Background(), dst, bytes.NewReader(src), extents, 0, 8*kib, save)
+	if err != errDest {
+		t.Fatalf("Wrong error of the interrupted copy, expected %v, got %v", errDest, err)
+	}
+	if saved != 16*kib {
+		t.Fatalf("Wrong saved offset, expected %d, got %d", 16*kib, saved)
+	}
+
+	dst.failing, dst.lowest = false, int64(len(src))
+	save = func(offset uint64) error {
+		saved = offset
+		return nil
+	}
+	if err := copyExtents(context.Background(), dst, bytes.NewReader(src), extents, saved, 8*kib, save); err != nil {
+		t.Fatalf("Cannot resume the copy at %d: %v", saved, err)
+	}
+	if dst.lowest < 16*kib {
+		t.Errorf("The resumed copy wrote at %d, before the saved offset %d", dst.lowest, 16*kib)
+	}
+	if !bytes.Equal(dst.data, src) {
+		t.Errorf("The copied data differs from the source")
+	}
+	if saved != 64*kib {
+		t.Errorf("Wrong last saved offset, expected %d, got %d", 64*kib, saved)
+	}
+}
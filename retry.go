@@ -0,0 +1,293 @@
+package rbd
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// EBLOCKLISTED is the error number of the calls made by a client after it
+// was blocklisted.  Ceph defines it as ESHUTDOWN.
+const EBLOCKLISTED = syscall.ESHUTDOWN
+
+// IsBlocklisted tells whether err reports that the client was
+// blocklisted.  The images it opened must be reopened, through a new
+// client if the blocklisting has not expired.
+func IsBlocklisted(err error) bool {
+	errno, ok := Errno(err)
+	return ok && errno == EBLOCKLISTED
+}
+
+// IsTransient tells whether err is a librbd error that may go away when
+// the call is retried.
+func IsTransient(err error) bool {
+	errno, ok := Errno(err)
+	if !ok {
+		return false
+	}
+	switch errno {
+	case syscall.ETIMEDOUT, syscall.EAGAIN, syscall.EINTR:
+		return true
+	}
+	return false
+}
+
+// idempotentOps are the operations, named like the ones reported to an
+// Observer, that leave the image in the same state whether they are
+// called once or several times.  The other ones, like create_snap which
+// fails with EEXIST once the snapshot exists, or flatten which fails with
+// EINVAL once the image has no parent, are not retried.
+var idempotentOps = map[string]bool{
+	"read":          true,
+	"write":         true,
+	"write_same":    true,
+	"write_zeroes":  true,
+	"discard":       true,
+	"flush":         true,
+	"resize":        true,
+	"rollback_snap": true,
+	"stat":          true,
+	"size":          true,
+}
+
+// Idempotent tells whether the operation op, named like the ones
+// reported to an Observer, can safely be retried.
+func Idempotent(op string) bool {
+	return idempotentOps[op]
+}
+
+// RetryPolicy retries the idempotent operations failing with transient
+// errors, with an exponential backoff.  The zero value makes 3 attempts,
+// waiting up to 100ms, then up to 200ms.
+type RetryPolicy struct {
+	// MaxAttempts is the number of calls made before giving up, 3 when
+	// zero.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, 100ms when zero.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts, 10s when zero.
+	MaxBackoff time.Duration
+	// Multiplier is the growth of the wait after each attempt, 2 when
+	// zero.
+	Multiplier float64
+	// Retryable tells whether an error is worth retrying, IsTransient
+	// when nil.
+	Retryable func(error) bool
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsTransient(err)
+}
+
+// backoff returns the wait before the attempt following the failed one,
+// jittered by up to a half so that the clients fenced together do not
+// retry together.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d, max, mult := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	if mult <= 0 {
+		mult = 2
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d = time.Duration(float64(d) * mult)
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Do calls f, the operation op, until it succeeds, fails with an error
+// that is not retryable, or runs out of attempts.  Operations that are
+// not idempotent are called once, and a flush failing because the client
+// was blocklisted is never retried: the writes it was to persist may be
+// lost, and a flush of a new handle would not report it.  Do returns the
+// last error of f, or the error of ctx if it is done while waiting.
+func (p RetryPolicy) Do(ctx context.Context, op string, f func() error) error {
+	return p.do(ctx, op, f, p.retryable)
+}
+
+func (p RetryPolicy) do(ctx context.Context, op string, f func() error, retryable func(error) bool) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !Idempotent(op) || attempt >= p.maxAttempts() || !retryable(err) {
+			return err
+		}
+		if op == "flush" && IsBlocklisted(err) {
+			return err
+		}
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RetryingImage is an image whose operations are retried according to a
+// policy.  When its client is blocklisted, the image is reopened with the
+// options it was first opened with, and the operation is retried if it
+// is idempotent.  It is safe for concurrent use.
+type RetryingImage struct {
+	policy RetryPolicy
+	// Reconnect, when set, is called after the client was blocklisted to
+	// get the connection reopening the image.  Otherwise the original
+	// one is used, which only works once the blocklisting has expired.
+	Reconnect func() (IoCtxGetter, error)
+
+	name    string
+	options []func(*Image) error
+
+	mu     sync.Mutex
+	rados  IoCtxGetter
+	img    *Image
+	closed bool
+}
+
+// OpenRetrying opens the image name with options, and returns it wrapped
+// with the retry policy.
+func OpenRetrying(rados IoCtxGetter, name string, policy RetryPolicy, options ...func(*Image) error) (*RetryingImage, error) {
+	img, err := NewImage(rados, name, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &RetryingImage{
+		policy:  policy,
+		name:    name,
+		options: options,
+		rados:   rados,
+		img:     img,
+	}, nil
+}
+
+// Image returns the current image handle, reopening it if needed.  It
+// must not be closed by the caller.
+func (ri *RetryingImage) Image() (*Image, error) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if ri.closed {
+		return nil, ErrClosed
+	}
+	if ri.img != nil {
+		return ri.img, nil
+	}
+	if ri.Reconnect != nil {
+		rados, err := ri.Reconnect()
+		if err != nil {
+			return nil, err
+		}
+		ri.rados = rados
+	}
+	img, err := NewImage(ri.rados, ri.name, ri.options...)
+	if err != nil {
+		return nil, err
+	}
+	ri.img = img
+	return img, nil
+}
+
+// fenced drops img after its client was blocklisted, so that the next
+// call reopens the image.
+func (ri *RetryingImage) fenced(img *Image) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if ri.img == img {
+		ri.img = nil
+		img.Close()
+	}
+}
+
+// Do calls f, the operation op, with the current image handle according
+// to the retry policy.
+func (ri *RetryingImage) Do(ctx context.Context, op string, f func(*Image) error) error {
+	attempt := func() error {
+		img, err := ri.Image()
+		if err != nil {
+			return err
+		}
+		err = f(img)
+		if IsBlocklisted(err) {
+			ri.fenced(img)
+		}
+		return err
+	}
+	retryable := func(err error) bool {
+		return err != ErrClosed && (IsBlocklisted(err) || ri.policy.retryable(err))
+	}
+	return ri.policy.do(ctx, op, attempt, retryable)
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (ri *RetryingImage) ReadAt(p []byte, off int64) (n int, err error) {
+	err = ri.Do(context.Background(), "read", func(img *Image) error {
+		n, err = img.ReadAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// WriteAt implements the io.WriterAt interface.
+func (ri *RetryingImage) WriteAt(p []byte, off int64) (n int, err error) {
+	err = ri.Do(context.Background(), "write", func(img *Image) error {
+		n, err = img.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// Discard discards the region of the image.
+func (ri *RetryingImage) Discard(offset int, length int) error {
+	return ri.Do(context.Background(), "discard", func(img *Image) error {
+		return img.Discard(offset, length)
+	})
+}
+
+// Flush blocks until all writes are fully flushed.  It is not retried
+// once the client is blocklisted, as the writes cached by the fenced
+// handle may be lost.
+func (ri *RetryingImage) Flush() error {
+	return ri.Do(context.Background(), "flush", func(img *Image) error {
+		return img.Flush()
+	})
+}
+
+// Size gets the size of the image.
+func (ri *RetryingImage) Size() (size uint64, err error) {
+	err = ri.Do(context.Background(), "size", func(img *Image) error {
+		size, err = img.Size()
+		return err
+	})
+	return size, err
+}
+
+// Close closes the image.  Closing a closed image does nothing.
+func (ri *RetryingImage) Close() error {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.closed = true
+	if ri.img == nil {
+		return nil
+	}
+	img := ri.img
+	ri.img = nil
+	return img.Close()
+}
@@ -0,0 +1,84 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Retention tells which snapshots to keep.  A snapshot is kept when any
+// of the rules selects it.  The hourly, daily, weekly and monthly rules
+// keep the most recent snapshot of each of the last N periods having
+// snapshots.  The zero value keeps all the snapshots.
+type Retention struct {
+	KeepLast int
+	Hourly   int
+	Daily    int
+	Weekly   int
+	Monthly  int
+}
+
+// Snapshot is a snapshot taken by the scheduler.
+type Snapshot struct {
+	Name string
+	Time time.Time
+}
+
+// periodRule keeps the most recent snapshot of count periods.
+type periodRule struct {
+	count  int
+	period func(time.Time) string
+}
+
+func (r Retention) periodRules() []periodRule {
+	return []periodRule{
+		{r.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+}
+
+// Apply splits snaps into the snapshots to keep and the ones to remove,
+// both sorted from the most recent to the oldest.
+func (r Retention) Apply(snaps []Snapshot) (keep []Snapshot, remove []Snapshot) {
+	sorted := make([]Snapshot, len(snaps))
+	copy(sorted, snaps)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.After(sorted[j].Time)
+	})
+
+	if r == (Retention{}) {
+		return sorted, nil
+	}
+
+	kept := make([]bool, len(sorted))
+	for i := 0; i < r.KeepLast && i < len(sorted); i++ {
+		kept[i] = true
+	}
+	for _, p := range r.periodRules() {
+		seen := make(map[string]bool)
+		for i, s := range sorted {
+			if len(seen) >= p.count {
+				break
+			}
+			period := p.period(s.Time.UTC())
+			if !seen[period] {
+				seen[period] = true
+				kept[i] = true
+			}
+		}
+	}
+
+	for i, s := range sorted {
+		if kept[i] {
+			keep = append(keep, s)
+		} else {
+			remove = append(remove, s)
+		}
+	}
+	return keep, remove
+}
@@ -0,0 +1,88 @@
+package schedule
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// hourlySnaps returns count snapshots taken every hour, the last one at
+// last.
+func hourlySnaps(last time.Time, count int) []Snapshot {
+	snaps := make([]Snapshot, count)
+	for i := range snaps {
+		t := last.Add(-time.Duration(i) * time.Hour)
+		snaps[i] = Snapshot{fmt.Sprintf("auto-%s", t.Format(timeFormat)), t}
+	}
+	return snaps
+}
+
+func names(snaps []Snapshot) []string {
+	res := make([]string, len(snaps))
+	for i, s := range snaps {
+		res[i] = s.Name
+	}
+	return res
+}
+
+func Test_RetentionKeepLast(t *testing.T) {
+	snaps := hourlySnaps(time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC), 5)
+	keep, remove := Retention{KeepLast: 2}.Apply(snaps)
+	if len(keep) != 2 || keep[0] != snaps[0] || keep[1] != snaps[1] {
+		t.Errorf("Wrong snapshots kept, got %v", names(keep))
+	}
+	if len(remove) != 3 {
+		t.Errorf("Wrong snapshots removed, got %v", names(remove))
+	}
+}
+
+func Test_RetentionDaily(t *testing.T) {
+	snaps := hourlySnaps(time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC), 72)
+	keep, remove := Retention{Daily: 3}.Apply(snaps)
+	expected := []string{
+		"auto-20200310T120000Z",
+		"auto-20200309T230000Z",
+		"auto-20200308T230000Z",
+	}
+	if fmt.Sprint(names(keep)) != fmt.Sprint(expected) {
+		t.Errorf("Wrong snapshots kept, expected %v, got %v", expected, names(keep))
+	}
+	if len(keep)+len(remove) != len(snaps) {
+		t.Errorf("Snapshots lost, kept %d, removed %d of %d", len(keep), len(remove), len(snaps))
+	}
+}
+
+func Test_RetentionCombined(t *testing.T) {
+	snaps := hourlySnaps(time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC), 24*40)
+	keep, _ := Retention{KeepLast: 1, Hourly: 2, Daily: 2, Weekly: 2, Monthly: 2}.Apply(snaps)
+	expected := []string{
+		"auto-20200310T120000Z", // last, hourly, daily, weekly, monthly
+		"auto-20200310T110000Z", // hourly
+		"auto-20200309T230000Z", // daily
+		"auto-20200308T230000Z", // weekly
+		"auto-20200229T230000Z", // monthly
+	}
+	if fmt.Sprint(names(keep)) != fmt.Sprint(expected) {
+		t.Errorf("Wrong snapshots kept, expected %v, got %v", expected, names(keep))
+	}
+}
+
+func Test_RetentionUnsorted(t *testing.T) {
+	snaps := hourlySnaps(time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC), 3)
+	snaps[0], snaps[2] = snaps[2], snaps[0]
+	keep, remove := Retention{KeepLast: 1}.Apply(snaps)
+	if len(keep) != 1 || keep[0].Name != "auto-20200310T120000Z" {
+		t.Errorf("Wrong snapshots kept, got %v", names(keep))
+	}
+	if len(remove) != 2 || remove[0].Name != "auto-20200310T110000Z" {
+		t.Errorf("Wrong snapshots removed, got %v", names(remove))
+	}
+}
+
+func Test_RetentionNone(t *testing.T) {
+	snaps := hourlySnaps(time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC), 3)
+	keep, remove := Retention{}.Apply(snaps)
+	if len(keep) != 3 || len(remove) != 0 {
+		t.Errorf("Wrong retention, kept %v, removed %v", names(keep), names(remove))
+	}
+}
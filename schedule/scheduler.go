@@ -0,0 +1,236 @@
+// Package schedule takes periodic snapshots of rbd images and prunes the
+// old ones according to retention rules.
+//
+// Snapshots are named after the Prefix of the Scheduler followed by their
+// UTC creation time, so that only the snapshots taken by the scheduler
+// are ever pruned.  Protected snapshots are never removed.
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	rbd "github.com/sathlan/librbdgo"
+)
+
+// timeFormat is the format of the time part of the snapshot names.
+const timeFormat = "20060102T150405Z"
+
+// Selector selects images of a pool.  An empty selector selects all the
+// images.
+type Selector struct {
+	// Name is a glob, as understood by path.Match, matched against the
+	// image name.
+	Name string
+	// MetadataKey, when set, restricts the selection to the images
+	// having this metadata key, with the value MetadataValue if it is
+	// not empty.
+	MetadataKey   string
+	MetadataValue string
+}
+
+// Target is a pool with the selectors of the images to snapshot.  An
+// image is selected if any of the selectors matches it.
+type Target struct {
+	Pool      *rbd.Rbd
+	Selectors []Selector
+}
+
+// Scheduler snapshots the selected images at each interval.
+type Scheduler struct {
+	Targets  []Target
+	Interval time.Duration
+	// Retention selects the snapshots removed after each run.  The zero
+	// value removes none.
+	Retention Retention
+	// Prefix of the snapshot names, "auto-" when empty.
+	Prefix string
+	// ErrorLog receives the errors of the runs started by Run.  Nothing
+	// is logged when it is nil.
+	ErrorLog *log.Logger
+
+	now func() time.Time
+}
+
+func (s *Scheduler) prefix() string {
+	if s.Prefix == "" {
+		return "auto-"
+	}
+	return s.Prefix
+}
+
+func (s *Scheduler) currentTime() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Run calls RunOnce at each interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.RunOnce(ctx); err != nil && s.ErrorLog != nil {
+			s.ErrorLog.Printf("schedule: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce snapshots and prunes all the selected images.  It carries on
+// after a failure on an image and returns the first error.
+func (s *Scheduler) RunOnce(ctx context.Context) error {
+	var firstErr error
+	for _, target := range s.Targets {
+		names, err := s.selected(target)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", target.Pool.PoolName, err)
+		}
+		for _, name := range names {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := s.snapshotAndPrune(target.Pool, name); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("%s/%s: %v", target.Pool.PoolName, name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// matches tells whether the selector matches the image name.
+func (sel Selector) matches(r *rbd.Rbd, name string) (bool, error) {
+	if sel.Name != "" {
+		ok, err := path.Match(sel.Name, name)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if sel.MetadataKey == "" {
+		return true, nil
+	}
+	img, err := rbd.NewImage(r, name, rbd.ReadOnly)
+	if err != nil {
+		return false, err
+	}
+	defer img.Close()
+	value, err := img.GetMetadata(sel.MetadataKey)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return sel.MetadataValue == "" || value == sel.MetadataValue, nil
+}
+
+// selected lists the images of the target matching one of its selectors.
+// The images removed meanwhile are skipped, and so are the ones failing
+// to match, whose first error is returned along with the others.
+func (s *Scheduler) selected(target Target) ([]string, error) {
+	names, err := target.Pool.List()
+	if err != nil {
+		return nil, err
+	}
+	return selectImages(names, target.Selectors, func(sel Selector, name string) (bool, error) {
+		return sel.matches(target.Pool, name)
+	})
+}
+
+func isNotFound(err error) bool {
+	errno, ok := rbd.Errno(err)
+	return ok && errno == syscall.ENOENT
+}
+
+// selectImages returns the names matching one of the selectors according
+// to match, all of them when there is no selector.
+func selectImages(names []string, selectors []Selector, match func(Selector, string) (bool, error)) ([]string, error) {
+	if len(selectors) == 0 {
+		selectors = []Selector{{}}
+	}
+	var res []string
+	var firstErr error
+	for _, name := range names {
+		for _, sel := range selectors {
+			ok, err := match(sel, name)
+			if isNotFound(err) {
+				break
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %v", name, err)
+				}
+				break
+			}
+			if ok {
+				res = append(res, name)
+				break
+			}
+		}
+	}
+	return res, firstErr
+}
+
+// Snapshots returns the snapshots of img taken by a scheduler using
+// prefix.
+func Snapshots(img *rbd.Image, prefix string) ([]Snapshot, error) {
+	snaps, err := img.ListSnaps()
+	if err != nil {
+		return nil, err
+	}
+	var res []Snapshot
+	for _, snap := range snaps {
+		if !strings.HasPrefix(snap.Name, prefix) {
+			continue
+		}
+		t, err := time.Parse(timeFormat, strings.TrimPrefix(snap.Name, prefix))
+		if err != nil {
+			continue
+		}
+		res = append(res, Snapshot{snap.Name, t})
+	}
+	return res, nil
+}
+
+// snapshotAndPrune snapshots the image name and removes the snapshots
+// that are not retained anymore.
+func (s *Scheduler) snapshotAndPrune(r *rbd.Rbd, name string) error {
+	img, err := rbd.NewImage(r, name)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	snapName := s.prefix() + s.currentTime().UTC().Format(timeFormat)
+	if err := img.CreateSnap(snapName); err != nil {
+		return err
+	}
+
+	snaps, err := Snapshots(img, s.prefix())
+	if err != nil {
+		return err
+	}
+	_, remove := s.Retention.Apply(snaps)
+	for _, snap := range remove {
+		protected, err := img.IsProtectedSnap(snap.Name)
+		if err != nil {
+			return err
+		}
+		if protected {
+			continue
+		}
+		if err := img.RemoveSnap(snap.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func Test_SelectImages(t *testing.T) {
+	failed := errors.New("failed")
+	match := func(sel Selector, name string) (bool, error) {
+		if name == "broken" {
+			return false, failed
+		}
+		return name != "skipped", nil
+	}
+	names := []string{"vm1", "broken", "skipped", "vm2"}
+	res, err := selectImages(names, nil, match)
+	if fmt.Sprint(res) != "[vm1 vm2]" {
+		t.Errorf("Wrong images selected after a failure, got %v", res)
+	}
+	if err == nil || err.Error() != "broken: failed" {
+		t.Errorf("Wrong error of the failed image, got %v", err)
+	}
+
+	res, err = selectImages([]string{"vm1"}, []Selector{{Name: "vm*"}}, match)
+	if err != nil || fmt.Sprint(res) != "[vm1]" {
+		t.Errorf("Wrong images selected, got %v, %v", res, err)
+	}
+}
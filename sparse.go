@@ -0,0 +1,213 @@
+package rbd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// copyChunkSize is the size of the buffer used by the sparse copy helpers.
+const copyChunkSize = 4 * 1024 * 1024
+
+// whence values of lseek(2) to find data and holes in a sparse file.  They
+// are missing from the os and syscall packages.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// imageDataExtents returns the allocated extents of img, parent included.
+func imageDataExtents(img *Image) ([]Extent, uint64, error) {
+	size, err := img.Size()
+	if err != nil {
+		return nil, 0, err
+	}
+	extents, err := img.ChangedExtents(context.Background(), "", 0, size, true, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	return extents, size, nil
+}
+
+// growImage makes sure dst is at least size bytes long.
+func growImage(dst *Image, size uint64) error {
+	dstSize, err := dst.Size()
+	if err != nil {
+		return err
+	}
+	if dstSize < size {
+		return dst.Resize(size)
+	}
+	return nil
+}
+
+// copyRange copies length bytes at offset from src to dst.  All-zero
+// chunks are passed to zero instead of being written.  It returns the
+// number of bytes written to dst.
+func copyRange(dst io.WriterAt, src io.ReaderAt, offset, length int64, buf []byte, zero func(offset, length int64) error) (int64, error) {
+	var written int64
+	for length > 0 {
+		chunk := buf
+		if int64(len(chunk)) > length {
+			chunk = chunk[:length]
+		}
+		n, err := src.ReadAt(chunk, offset)
+		if err != nil && !(err == io.EOF && n == len(chunk)) {
+			return written, err
+		}
+		chunk = chunk[:n]
+		if isZero(chunk) {
+			if err := zero(offset, int64(n)); err != nil {
+				return written, err
+			}
+		} else {
+			if _, err := dst.WriteAt(chunk, offset); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		offset += int64(n)
+		length -= int64(n)
+	}
+	return written, nil
+}
+
+// CopySparse copies the content of the src image to the dst image, which
+// is grown if needed.  Only the allocated extents of src are read and
+// all-zero chunks are discarded instead of being written, so dst is
+// expected to be empty, like a freshly created image.  It returns the
+// number of bytes written.
+func CopySparse(dst *Image, src *Image) (int64, error) {
+	return copySparse(dst, src, src)
+}
+
+// copySparse is CopySparse reading the data of src through reader.
+func copySparse(dst *Image, src *Image, reader io.ReaderAt) (int64, error) {
+	extents, size, err := imageDataExtents(src)
+	if err != nil {
+		return 0, err
+	}
+	if err := growImage(dst, size); err != nil {
+		return 0, err
+	}
+	discard := func(offset, length int64) error {
+		return dst.Discard(int(offset), int(length))
+	}
+	buf := chunkPool.Get()
+	defer chunkPool.Put(buf)
+	var written int64
+	for _, e := range extents {
+		if !e.Exists {
+			continue
+		}
+		n, err := copyRange(dst, reader, int64(e.Offset), int64(e.Length), *buf, discard)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, dst.Flush()
+}
+
+// CopySparseToFile copies the content of the src image to the dst file.
+// The file is truncated to the image size and zero chunks are left as
+// holes.  It returns the number of bytes written.
+func CopySparseToFile(dst *os.File, src *Image) (int64, error) {
+	return copySparseToFile(dst, src, src)
+}
+
+// copySparseToFile is CopySparseToFile reading the data of src through
+// reader.
+func copySparseToFile(dst *os.File, src *Image, reader io.ReaderAt) (int64, error) {
+	extents, size, err := imageDataExtents(src)
+	if err != nil {
+		return 0, err
+	}
+	if err := dst.Truncate(int64(size)); err != nil {
+		return 0, err
+	}
+	skip := func(offset, length int64) error {
+		return nil
+	}
+	buf := chunkPool.Get()
+	defer chunkPool.Put(buf)
+	var written int64
+	for _, e := range extents {
+		if !e.Exists {
+			continue
+		}
+		n, err := copyRange(dst, reader, int64(e.Offset), int64(e.Length), *buf, skip)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// fileDataExtents returns the data extents of a sparse file.  When the
+// file system does not support SEEK_DATA the whole file is returned.
+func fileDataExtents(f *os.File, size int64) ([]Extent, error) {
+	var extents []Extent
+	for offset := int64(0); offset < size; {
+		start, err := f.Seek(offset, seekData)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				// no more data after offset
+				break
+			}
+			return []Extent{{0, uint64(size), true}}, nil
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return []Extent{{0, uint64(size), true}}, nil
+		}
+		extents = append(extents, Extent{uint64(start), uint64(end - start), true})
+		offset = end
+	}
+	return extents, nil
+}
+
+// CopySparseFromFile copies the content of the src file to the dst image,
+// which is grown if needed.  Holes of src are skipped and all-zero chunks
+// are discarded instead of being written, so dst is expected to be empty,
+// like a freshly created image.  It returns the number of bytes written.
+func CopySparseFromFile(dst *Image, src *os.File) (int64, error) {
+	fi, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	extents, err := fileDataExtents(src, size)
+	if err != nil {
+		return 0, err
+	}
+	if err := growImage(dst, uint64(size)); err != nil {
+		return 0, err
+	}
+	discard := func(offset, length int64) error {
+		return dst.Discard(int(offset), int(length))
+	}
+	buf := chunkPool.Get()
+	defer chunkPool.Put(buf)
+	var written int64
+	for _, e := range extents {
+		n, err := copyRange(dst, src, int64(e.Offset), int64(e.Length), *buf, discard)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, dst.Flush()
+}
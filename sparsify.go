@@ -0,0 +1,111 @@
+package rbd
+
+import "context"
+import "fmt"
+import "syscall"
+
+// minSparseSize is the smallest sparse size accepted by librbd.
+const minSparseSize = 4096
+
+func checkSparseSize(sparseSize uint64) error {
+	if sparseSize < minSparseSize || sparseSize&(sparseSize-1) != 0 {
+		return fmt.Errorf("Invalid sparse size %d: must be a power of two of at least %d", sparseSize, minSparseSize)
+	}
+	return nil
+}
+
+// Sparsify deallocates the zero-filled blocks of sparseSize bytes of the
+// image.  sparseSize must be a power of two of at least 4096.
+func (img *Image) Sparsify(sparseSize uint64) error {
+	return img.SparsifyWithProgress(sparseSize, nil)
+}
+
+// SparsifyWithProgress is Sparsify reporting its progress to progress if
+// it is not nil.  When librbd refuses to sparsify, or when the package is
+// built with the rbd_no_sparsify tag for a librbd older than nautilus
+// which lacks rbd_sparsify, the image is scanned for zero blocks which
+// are discarded.
+func (img *Image) SparsifyWithProgress(sparseSize uint64, progress ProgressFunc) error {
+	return img.SparsifyContext(context.Background(), sparseSize, progress)
+}
+
+// SparsifyContext is SparsifyWithProgress passing ctx to the observer.
+// ctx also cancels the scan of the image when librbd does not support
+// sparsify.
+func (img *Image) SparsifyContext(ctx context.Context, sparseSize uint64, progress ProgressFunc) error {
+	if err := checkSparseSize(sparseSize); err != nil {
+		return err
+	}
+	err := img.sparsify(ctx, sparseSize, progress)
+	if errno, ok := Errno(err); ok && (errno == syscall.EOPNOTSUPP || errno == syscall.ENOSYS) {
+		return img.sparsifyByDiscard(ctx, sparseSize, progress)
+	}
+	return err
+}
+
+// sparsifyByDiscard discards the zero-filled blocks of sparseSize bytes,
+// aligned on sparseSize, of the allocated extents of the image.
+func (img *Image) sparsifyByDiscard(ctx context.Context, sparseSize uint64, progress ProgressFunc) error {
+	size, err := img.SizeContext(ctx)
+	if err != nil {
+		return err
+	}
+	extents, err := img.ChangedExtents(ctx, "", 0, size, false, false)
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	if sparseSize <= uint64(chunkPool.Size()) {
+		pooled := chunkPool.Get()
+		defer chunkPool.Put(pooled)
+		buf = (*pooled)[:sparseSize]
+	} else {
+		buf = make([]byte, sparseSize)
+	}
+	// Zero blocks are discarded by runs.
+	var runStart, runLength uint64
+	flush := func() error {
+		if runLength == 0 {
+			return nil
+		}
+		err := img.DiscardContext(ctx, int(runStart), int(runLength))
+		runLength = 0
+		return err
+	}
+	for _, e := range extents {
+		if !e.Exists {
+			continue
+		}
+		start := (e.Offset + sparseSize - 1) / sparseSize * sparseSize
+		end := (e.Offset + e.Length) / sparseSize * sparseSize
+		for off := start; off < end; off += sparseSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n, err := img.ReadRawIntoContext(ctx, buf, uint(off))
+			if err != nil {
+				return err
+			}
+			// the read is short at the end of the image
+			if !isZero(buf[:n]) {
+				if err := flush(); err != nil {
+					return err
+				}
+				continue
+			}
+			if runLength == 0 {
+				runStart = off
+			}
+			runLength += sparseSize
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if progress != nil {
+			if err := progress(e.Offset+e.Length, size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
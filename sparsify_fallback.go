@@ -0,0 +1,16 @@
+//go:build rbd_no_sparsify
+// +build rbd_no_sparsify
+
+package rbd
+
+// #include <errno.h>
+import "C"
+import "context"
+import "fmt"
+import "time"
+
+// sparsify fails with ENOSYS, as librbd has no rbd_sparsify.
+func (img *Image) sparsify(ctx context.Context, sparseSize uint64, progress ProgressFunc) (err error) {
+	defer img.observe(ctx, "sparsify", time.Now(), nil, &err)
+	return &cError{fmt.Sprintf("Cannot sparsify image %s", img.name), 0, -C.ENOSYS}
+}
@@ -0,0 +1,40 @@
+//go:build !rbd_no_sparsify
+// +build !rbd_no_sparsify
+
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+
+extern int goProgressCB(uint64_t, uint64_t, void *);
+
+static int goSparsifyWithProgress(rbd_image_t image, size_t sparseSize, uintptr_t handle) {
+   return rbd_sparsify_with_progress(image, sparseSize, goProgressCB, (void *)handle);
+}
+*/
+import "C"
+import "context"
+import "fmt"
+import "time"
+
+func (img *Image) sparsify(ctx context.Context, sparseSize uint64, progress ProgressFunc) (err error) {
+	defer img.observe(ctx, "sparsify", time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	if progress == nil {
+		retC := C.rbd_sparsify(img.getC(), C.size_t(sparseSize))
+		if retC < 0 {
+			return &cError{fmt.Sprintf("Cannot sparsify image %s", img.name), 0, retC}
+		}
+		return nil
+	}
+	return img.withProgress(progress, func(handle C.uintptr_t) C.int {
+		return C.goSparsifyWithProgress(img.getC(), C.size_t(sparseSize), handle)
+	}, "Cannot sparsify image %s")
+}
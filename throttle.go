@@ -0,0 +1,459 @@
+package rbd
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Priority is the class of the I/Os of a Throttled image.  The waiting
+// I/Os of a Limiter are served by priority, so that background jobs only
+// get what the latency-sensitive workloads leave.
+type Priority int
+
+const (
+	// Interactive is the class of latency-sensitive I/Os.  It is served
+	// first.
+	Interactive Priority = iota
+	// Normal is the default class.
+	Normal
+	// Background is the class of bulk jobs like exports, flattens and
+	// backups.
+	Background
+	numPriorities
+)
+
+// Limits are the rates allowed by a Limiter.  A zero rate is unlimited.
+// Each rate can be exceeded by a burst of one second worth of I/Os.
+type Limits struct {
+	IOPS           float64
+	BytesPerSecond float64
+}
+
+// bucket is a token bucket.  Requests larger than its capacity are let
+// through when it is full, leaving it in debt.
+type bucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+}
+
+func newBucket(rate float64) bucket {
+	return bucket{rate, rate, rate}
+}
+
+func (b *bucket) refill(elapsed float64) {
+	if b.rate != 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+b.rate*elapsed)
+	}
+}
+
+func (b *bucket) ready(n float64) bool {
+	return b.rate == 0 || b.tokens >= math.Min(n, b.capacity)
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate != 0 {
+		b.tokens -= n
+	}
+}
+
+// give returns n tokens taken from the bucket.
+func (b *bucket) give(n float64) {
+	if b.rate != 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+n)
+	}
+}
+
+// delay returns how long to wait for n tokens.
+func (b *bucket) delay(n float64) time.Duration {
+	if b.ready(n) {
+		return 0
+	}
+	return time.Duration((math.Min(n, b.capacity) - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Limiter enforces IOPS and bandwidth limits on the I/Os of the Throttled
+// images sharing it.  A limiter can be used per image, or shared by all
+// the images of a Rbd to limit them as a group.  It is safe for
+// concurrent use.
+type Limiter struct {
+	mu     sync.Mutex
+	ops    bucket
+	bytes  bucket
+	last   time.Time
+	queues [numPriorities][]*waiter
+	timer  *time.Timer
+}
+
+type waiter struct {
+	bytes float64
+	ready chan struct{}
+}
+
+// NewLimiter returns a limiter enforcing limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		ops:   newBucket(limits.IOPS),
+		bytes: newBucket(limits.BytesPerSecond),
+		last:  time.Now(),
+	}
+}
+
+func (l *Limiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	l.ops.refill(elapsed)
+	l.bytes.refill(elapsed)
+}
+
+func (l *Limiter) fits(n float64) bool {
+	return l.ops.ready(1) && l.bytes.ready(n)
+}
+
+func (l *Limiter) take(n float64) {
+	l.ops.take(1)
+	l.bytes.take(n)
+}
+
+// refund gives back the tokens of an I/O of n bytes that was let through
+// but not done.
+func (l *Limiter) refund(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.ops.give(1)
+	l.bytes.give(float64(n))
+	l.dispatchLocked()
+}
+
+// queued tells whether I/Os of priority p or higher are waiting.
+func (l *Limiter) queued(p Priority) bool {
+	for i := Interactive; i <= p; i++ {
+		if len(l.queues[i]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait blocks until an I/O of n bytes of priority p is allowed, or until
+// ctx is done.
+func (l *Limiter) Wait(ctx context.Context, p Priority, n int) error {
+	if p < Interactive || p >= numPriorities {
+		p = Normal
+	}
+	l.mu.Lock()
+	l.refill()
+	if !l.queued(p) && l.fits(float64(n)) {
+		l.take(float64(n))
+		l.mu.Unlock()
+		return nil
+	}
+	w := &waiter{float64(n), make(chan struct{})}
+	l.queues[p] = append(l.queues[p], w)
+	l.dispatchLocked()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		// granted meanwhile
+		return nil
+	default:
+	}
+	for i, queued := range l.queues[p] {
+		if queued == w {
+			l.queues[p] = append(l.queues[p][:i], l.queues[p][i+1:]...)
+			break
+		}
+	}
+	l.dispatchLocked()
+	return ctx.Err()
+}
+
+func (l *Limiter) dispatch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dispatchLocked()
+}
+
+// dispatchLocked lets the waiting I/Os through by priority while the
+// buckets allow it, and arms the timer for the next one.
+func (l *Limiter) dispatchLocked() {
+	l.refill()
+	for p := range l.queues {
+		for len(l.queues[p]) > 0 {
+			w := l.queues[p][0]
+			if !l.fits(w.bytes) {
+				d := l.ops.delay(1)
+				if bd := l.bytes.delay(w.bytes); bd > d {
+					d = bd
+				}
+				if d < time.Millisecond {
+					d = time.Millisecond
+				}
+				if l.timer == nil {
+					l.timer = time.AfterFunc(d, l.dispatch)
+				} else {
+					l.timer.Reset(d)
+				}
+				return
+			}
+			l.take(w.bytes)
+			close(w.ready)
+			l.queues[p] = l.queues[p][1:]
+		}
+	}
+}
+
+// Throttled is an image whose reads, writes and discards wait for its
+// limiters.  Discards and zero writes count as an I/O but do not use
+// bandwidth, and a compare and write uses the bandwidth of both buffers.
+// The other methods are the ones of the Image and are not throttled.
+type Throttled struct {
+	*Image
+	priority Priority
+	limiters []*Limiter
+}
+
+// Throttle returns img throttled by limiters, with the priority class p.
+func Throttle(img *Image, p Priority, limiters ...*Limiter) *Throttled {
+	return &Throttled{img, p, limiters}
+}
+
+// wait waits for all the limiters.  When it gives up, the tokens taken
+// from the limiters already waited for are given back.
+func (t *Throttled) wait(ctx context.Context, n int) error {
+	for i, l := range t.limiters {
+		if err := l.Wait(ctx, t.priority, n); err != nil {
+			for _, taken := range t.limiters[:i] {
+				taken.refund(n)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// clampLength returns n as an int, clamped for the lengths that do not
+// fit one.
+func clampLength(n uint64) int {
+	if n > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(n)
+}
+
+// Read implements the io.Reader interface.
+func (t *Throttled) Read(p []byte) (int, error) {
+	if err := t.wait(context.Background(), len(p)); err != nil {
+		return 0, err
+	}
+	return t.Image.Read(p)
+}
+
+// Write implements the io.Writer interface.
+func (t *Throttled) Write(p []byte) (int, error) {
+	if err := t.wait(context.Background(), len(p)); err != nil {
+		return 0, err
+	}
+	return t.Image.Write(p)
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (t *Throttled) ReadAt(p []byte, off int64) (int, error) {
+	return t.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is ReadAt giving up waiting when ctx is done.
+func (t *Throttled) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := t.wait(ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return t.Image.ReadAtContext(ctx, p, off)
+}
+
+// WriteAt implements the io.WriterAt interface.
+func (t *Throttled) WriteAt(p []byte, off int64) (int, error) {
+	return t.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext is WriteAt giving up waiting when ctx is done.
+func (t *Throttled) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := t.wait(ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return t.Image.WriteAtContext(ctx, p, off)
+}
+
+// ReadRaw reads length bytes at offset from the image.
+//
+// Deprecated: use ReadRawInto, which reads into a buffer of the caller.
+func (t *Throttled) ReadRaw(offset, length uint) (string, error) {
+	if err := t.wait(context.Background(), clampLength(uint64(length))); err != nil {
+		return "", err
+	}
+	return t.Image.ReadRaw(offset, length)
+}
+
+// ReadRawInto reads len(p) bytes at offset from the image into p.
+func (t *Throttled) ReadRawInto(p []byte, offset uint) (int, error) {
+	return t.ReadRawIntoContext(context.Background(), p, offset)
+}
+
+// ReadRawIntoContext is ReadRawInto giving up waiting when ctx is done.
+func (t *Throttled) ReadRawIntoContext(ctx context.Context, p []byte, offset uint) (int, error) {
+	if err := t.wait(ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return t.Image.ReadRawIntoContext(ctx, p, offset)
+}
+
+// WriteRaw writes data at offset in the image.
+//
+// Deprecated: use WriteRawFrom, which takes a []byte.
+func (t *Throttled) WriteRaw(data string, offset uint) (int, error) {
+	if err := t.wait(context.Background(), len(data)); err != nil {
+		return -1, err
+	}
+	return t.Image.WriteRaw(data, offset)
+}
+
+// WriteRawFrom writes p at offset in the image.
+func (t *Throttled) WriteRawFrom(p []byte, offset uint) (int, error) {
+	return t.WriteRawFromContext(context.Background(), p, offset)
+}
+
+// WriteRawFromContext is WriteRawFrom giving up waiting when ctx is done.
+func (t *Throttled) WriteRawFromContext(ctx context.Context, p []byte, offset uint) (int, error) {
+	if err := t.wait(ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return t.Image.WriteRawFromContext(ctx, p, offset)
+}
+
+func vectorLength(bufs [][]byte) int {
+	n := 0
+	for _, buf := range bufs {
+		n += len(buf)
+	}
+	return n
+}
+
+// AioReadV starts reading the data at offset into bufs once the limiters
+// allow it.
+func (t *Throttled) AioReadV(offset uint64, bufs [][]byte) (*Completion, error) {
+	if err := t.wait(context.Background(), vectorLength(bufs)); err != nil {
+		return nil, err
+	}
+	return t.Image.AioReadV(offset, bufs)
+}
+
+// AioWriteV starts writing bufs at offset once the limiters allow it.
+func (t *Throttled) AioWriteV(offset uint64, bufs [][]byte) (*Completion, error) {
+	if err := t.wait(context.Background(), vectorLength(bufs)); err != nil {
+		return nil, err
+	}
+	return t.Image.AioWriteV(offset, bufs)
+}
+
+// ReadV reads the data at offset into bufs, one after the other.
+func (t *Throttled) ReadV(offset uint64, bufs [][]byte) (int, error) {
+	return t.ReadVContext(context.Background(), offset, bufs)
+}
+
+// ReadVContext is ReadV giving up waiting when ctx is done.
+func (t *Throttled) ReadVContext(ctx context.Context, offset uint64, bufs [][]byte) (int, error) {
+	if err := t.wait(ctx, vectorLength(bufs)); err != nil {
+		return 0, err
+	}
+	return t.Image.ReadVContext(ctx, offset, bufs)
+}
+
+// WriteV writes bufs, one after the other, at offset.
+func (t *Throttled) WriteV(offset uint64, bufs [][]byte) (int, error) {
+	return t.WriteVContext(context.Background(), offset, bufs)
+}
+
+// WriteVContext is WriteV giving up waiting when ctx is done.
+func (t *Throttled) WriteVContext(ctx context.Context, offset uint64, bufs [][]byte) (int, error) {
+	if err := t.wait(ctx, vectorLength(bufs)); err != nil {
+		return 0, err
+	}
+	return t.Image.WriteVContext(ctx, offset, bufs)
+}
+
+// Discard discards the region of the image.
+func (t *Throttled) Discard(offset int, length int) error {
+	return t.DiscardContext(context.Background(), offset, length)
+}
+
+// DiscardContext is Discard giving up waiting when ctx is done.
+func (t *Throttled) DiscardContext(ctx context.Context, offset int, length int) error {
+	if err := t.wait(ctx, 0); err != nil {
+		return err
+	}
+	return t.Image.DiscardContext(ctx, offset, length)
+}
+
+// WriteSame fills length bytes at offset with copies of pattern.
+func (t *Throttled) WriteSame(offset uint64, length uint64, pattern []byte) error {
+	return t.WriteSameContext(context.Background(), offset, length, pattern)
+}
+
+// WriteSameContext is WriteSame giving up waiting when ctx is done.
+func (t *Throttled) WriteSameContext(ctx context.Context, offset uint64, length uint64, pattern []byte) error {
+	if err := t.wait(ctx, clampLength(length)); err != nil {
+		return err
+	}
+	return t.Image.WriteSameContext(ctx, offset, length, pattern)
+}
+
+// WriteZeroes zeroes length bytes at offset.
+func (t *Throttled) WriteZeroes(offset uint64, length uint64, flags int) error {
+	return t.WriteZeroesContext(context.Background(), offset, length, flags)
+}
+
+// WriteZeroesContext is WriteZeroes giving up waiting when ctx is done.
+func (t *Throttled) WriteZeroesContext(ctx context.Context, offset uint64, length uint64, flags int) error {
+	if err := t.wait(ctx, 0); err != nil {
+		return err
+	}
+	return t.Image.WriteZeroesContext(ctx, offset, length, flags)
+}
+
+// CompareAndWrite writes buf at offset if the data there matches cmp.
+func (t *Throttled) CompareAndWrite(offset uint64, cmp []byte, buf []byte) (uint64, error) {
+	return t.CompareAndWriteContext(context.Background(), offset, cmp, buf)
+}
+
+// CompareAndWriteContext is CompareAndWrite giving up waiting when ctx is
+// done.
+func (t *Throttled) CompareAndWriteContext(ctx context.Context, offset uint64, cmp []byte, buf []byte) (uint64, error) {
+	if err := t.wait(ctx, len(cmp)+len(buf)); err != nil {
+		return 0, err
+	}
+	return t.Image.CompareAndWriteContext(ctx, offset, cmp, buf)
+}
+
+// CopySparse is the CopySparse function reading the image through the
+// limiters.
+func (t *Throttled) CopySparse(dst *Image) (int64, error) {
+	return copySparse(dst, t.Image, t)
+}
+
+// CopySparseToFile is the CopySparseToFile function reading the image
+// through the limiters.
+func (t *Throttled) CopySparseToFile(dst *os.File) (int64, error) {
+	return copySparseToFile(dst, t.Image, t)
+}
@@ -0,0 +1,202 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+*/
+import "C"
+import "context"
+import "fmt"
+import "sync"
+import "syscall"
+import "unsafe"
+import "time"
+
+// ImageUsage is the space consumed by an image or one of its snapshots.
+type ImageUsage struct {
+	Name        string
+	Snapshot    string
+	Provisioned uint64
+	Used        uint64
+}
+
+// PoolStats holds the statistics librbd keeps about a pool.
+type PoolStats struct {
+	Images                   uint64
+	ImageProvisionedBytes    uint64
+	ImageMaxProvisionedBytes uint64
+	ImageSnapshots           uint64
+	TrashImages              uint64
+	TrashProvisionedBytes    uint64
+	TrashMaxProvisionedBytes uint64
+	TrashSnapshots           uint64
+}
+
+// DiskUsage computes the number of bytes allocated by the image, or by
+// the snapshot it is set to, since fromSnapshot.  An empty fromSnapshot
+// counts every allocated byte.  When the fast-diff feature is enabled the
+// object map is used and whole objects are accounted.
+func (img *Image) DiskUsage(fromSnapshot string) (uint64, error) {
+	features, err := img.Features()
+	if err != nil {
+		return 0, err
+	}
+	size, err := img.Size()
+	if err != nil {
+		return 0, err
+	}
+	var used uint64
+	count := func(e Extent) error {
+		if e.Exists {
+			used += e.Length
+		}
+		return nil
+	}
+	err = img.DiffIterate2(context.Background(), fromSnapshot, 0, size, false, features&FastDiffMask != 0, count)
+	if err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// imageUsage computes the usage of every snapshot of the image name,
+// followed by the usage of the image head.
+func (r *Rbd) imageUsage(name string) ([]ImageUsage, error) {
+	img, err := NewImage(r, name, ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	snaps, err := img.ListSnaps()
+	if err != nil {
+		return nil, err
+	}
+	var res []ImageUsage
+	from := ""
+	for _, snap := range snaps {
+		snapImg, err := NewImage(r, name, ReadOnly, SnapshotName(snap.Name))
+		if isNotFound(err) {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		used, err := snapImg.DiskUsage(from)
+		snapImg.Close()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ImageUsage{name, snap.Name, snap.Size, used})
+		from = snap.Name
+	}
+	size, err := img.Size()
+	if err != nil {
+		return nil, err
+	}
+	used, err := img.DiskUsage(from)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, ImageUsage{name, "", size, used}), nil
+}
+
+// DiskUsage computes the usage of all the images of the pool and of their
+// snapshots, inspecting at most parallelism images at the same time.
+// The images removed during the scan are skipped.
+func (r *Rbd) DiskUsage(parallelism int) ([]ImageUsage, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	names, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	usages := make([][]ImageUsage, len(names))
+	errs := make([]error, len(names))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			usages[i], errs[i] = r.imageUsage(name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	var res []ImageUsage
+	for i := range names {
+		if isNotFound(errs[i]) {
+			continue
+		}
+		if errs[i] != nil {
+			return nil, fmt.Errorf("Cannot compute disk usage of image %s: %v", names[i], errs[i])
+		}
+		res = append(res, usages[i]...)
+	}
+	return res, nil
+}
+
+// isNotFound tells whether err is a librbd ENOENT error.
+func isNotFound(err error) bool {
+	errno, ok := Errno(err)
+	return ok && errno == syscall.ENOENT
+}
+
+// PoolStats gets the statistics of the pool.
+func (r *Rbd) PoolStats() (PoolStats, error) {
+	return r.PoolStatsContext(context.Background())
+}
+
+// PoolStatsContext is PoolStats passing ctx to the observer.
+func (r *Rbd) PoolStatsContext(ctx context.Context) (_ PoolStats, err error) {
+	defer r.observe(ctx, "pool_stats", "", time.Now(), &err)
+	if err := r.lock(); err != nil {
+		return PoolStats{}, err
+	}
+	defer r.unlock()
+	options := []C.int{
+		C.RBD_POOL_STAT_OPTION_IMAGES,
+		C.RBD_POOL_STAT_OPTION_IMAGE_PROVISIONED_BYTES,
+		C.RBD_POOL_STAT_OPTION_IMAGE_MAX_PROVISIONED_BYTES,
+		C.RBD_POOL_STAT_OPTION_IMAGE_SNAPSHOTS,
+		C.RBD_POOL_STAT_OPTION_TRASH_IMAGES,
+		C.RBD_POOL_STAT_OPTION_TRASH_PROVISIONED_BYTES,
+		C.RBD_POOL_STAT_OPTION_TRASH_MAX_PROVISIONED_BYTES,
+		C.RBD_POOL_STAT_OPTION_TRASH_SNAPSHOTS,
+	}
+	// librbd keeps the value pointers until rbd_pool_stats_get, so they
+	// must live in C memory.
+	valuesC := (*[8]C.uint64_t)(C.calloc(C.size_t(len(options)), C.sizeof_uint64_t))
+	defer C.free(unsafe.Pointer(valuesC))
+
+	var statsC C.rbd_pool_stats_t
+	C.rbd_pool_stats_create(&statsC)
+	defer C.rbd_pool_stats_destroy(statsC)
+	for i, option := range options {
+		retC := C.rbd_pool_stats_option_add_uint64(statsC, option, &valuesC[i])
+		if retC < 0 {
+			return PoolStats{}, &cError{fmt.Sprintf("Cannot add pool stat option %d", int(option)), 0, retC}
+		}
+	}
+	retC := C.rbd_pool_stats_get(r.GetHandle(), statsC)
+	if retC < 0 {
+		return PoolStats{}, &cError{fmt.Sprintf("Cannot get stats of pool %s", r.PoolName), 0, retC}
+	}
+	return PoolStats{
+		Images:                   uint64(valuesC[0]),
+		ImageProvisionedBytes:    uint64(valuesC[1]),
+		ImageMaxProvisionedBytes: uint64(valuesC[2]),
+		ImageSnapshots:           uint64(valuesC[3]),
+		TrashImages:              uint64(valuesC[4]),
+		TrashProvisionedBytes:    uint64(valuesC[5]),
+		TrashMaxProvisionedBytes: uint64(valuesC[6]),
+		TrashSnapshots:           uint64(valuesC[7]),
+	}, nil
+}
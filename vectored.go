@@ -0,0 +1,168 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <sys/uio.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+*/
+import "C"
+import "context"
+import "fmt"
+import "io"
+import "runtime"
+import "time"
+import "unsafe"
+
+// Completion is a vectored I/O in progress.  Wait must be called once
+// for each Completion to release it, and before closing the image.
+type Completion struct {
+	img    *Image
+	ctx    context.Context
+	op     string
+	offset uint64
+	start  time.Time
+	length int
+	c      C.rbd_completion_t
+	iov    *C.struct_iovec
+	pinner runtime.Pinner
+}
+
+// iovecs pins bufs and returns them as an iovec array in C memory, as
+// librbd uses them after the call submitting the I/O returns.  Empty
+// buffers are skipped.
+func (cp *Completion) iovecs(bufs [][]byte) C.int {
+	count := 0
+	for _, buf := range bufs {
+		if len(buf) > 0 {
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	cp.iov = (*C.struct_iovec)(C.malloc(C.size_t(count) * C.size_t(unsafe.Sizeof(C.struct_iovec{}))))
+	iov := unsafe.Slice(cp.iov, count)
+	i := 0
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		cp.pinner.Pin(&buf[0])
+		iov[i].iov_base = unsafe.Pointer(&buf[0])
+		iov[i].iov_len = C.size_t(len(buf))
+		cp.length += len(buf)
+		i++
+	}
+	return C.int(count)
+}
+
+func (cp *Completion) release() {
+	if cp.c != nil {
+		C.rbd_aio_release(cp.c)
+	}
+	if cp.iov != nil {
+		C.free(unsafe.Pointer(cp.iov))
+	}
+	cp.pinner.Unpin()
+}
+
+// Wait waits for the I/O to complete and returns the number of bytes
+// transferred.  Like ReadAt and WriteAt, it returns io.EOF when less bytes
+// than the length of the buffers were transferred.
+func (cp *Completion) Wait() (n int, err error) {
+	defer cp.img.observeIO(cp.ctx, cp.op, int64(cp.offset), cp.length, cp.start, &n, &err)
+	if cp.length == 0 {
+		return 0, nil
+	}
+	defer cp.img.inflight.Done()
+	defer cp.release()
+	C.rbd_aio_wait_for_complete(cp.c)
+	retC := C.rbd_aio_get_return_value(cp.c)
+	if retC == -C.EINVAL {
+		return 0, io.EOF
+	}
+	if retC < 0 {
+		return 0, &cError{fmt.Sprintf("Cannot %s %d bytes in image %s", cp.op, cp.length, cp.img.name), 0, C.int(retC)}
+	}
+	if int(retC) < cp.length {
+		return int(retC), io.EOF
+	}
+	return int(retC), nil
+}
+
+// aioV submits a vectored I/O of bufs at offset.
+func (img *Image) aioV(ctx context.Context, op string, offset uint64, bufs [][]byte) (*Completion, error) {
+	if err := img.lock(); err != nil {
+		return nil, err
+	}
+	defer img.unlock()
+	cp := &Completion{img: img, ctx: ctx, op: op, offset: offset, start: time.Now()}
+	count := cp.iovecs(bufs)
+	if count == 0 {
+		return cp, nil
+	}
+	retC := C.rbd_aio_create_completion(nil, nil, &cp.c)
+	if retC < 0 {
+		cp.c = nil
+		cp.release()
+		return nil, &cError{fmt.Sprintf("Cannot create completion for image %s", img.name), 0, retC}
+	}
+	if op == "readv" {
+		retC = C.rbd_aio_readv(img.getC(), cp.iov, count, C.uint64_t(offset), cp.c)
+	} else {
+		retC = C.rbd_aio_writev(img.getC(), cp.iov, count, C.uint64_t(offset), cp.c)
+	}
+	if retC < 0 {
+		cp.release()
+		return nil, &cError{fmt.Sprintf("Cannot %s %d bytes at %d in image %s", op, cp.length, offset, img.name), 0, retC}
+	}
+	// Close waits for Wait, as the image is read-locked only during the
+	// submission.
+	img.inflight.Add(1)
+	return cp, nil
+}
+
+// AioReadV starts reading the data at offset into bufs, one after the
+// other.  bufs must not be used until Wait returns.
+func (img *Image) AioReadV(offset uint64, bufs [][]byte) (*Completion, error) {
+	return img.aioV(context.Background(), "readv", offset, bufs)
+}
+
+// AioWriteV starts writing bufs, one after the other, at offset.  bufs
+// must not be modified until Wait returns.
+func (img *Image) AioWriteV(offset uint64, bufs [][]byte) (*Completion, error) {
+	return img.aioV(context.Background(), "writev", offset, bufs)
+}
+
+// ReadV reads the data at offset into bufs, one after the other, without
+// intermediate copies.
+func (img *Image) ReadV(offset uint64, bufs [][]byte) (int, error) {
+	return img.ReadVContext(context.Background(), offset, bufs)
+}
+
+// ReadVContext is ReadV passing ctx to the observer.
+func (img *Image) ReadVContext(ctx context.Context, offset uint64, bufs [][]byte) (int, error) {
+	cp, err := img.aioV(ctx, "readv", offset, bufs)
+	if err != nil {
+		return 0, err
+	}
+	return cp.Wait()
+}
+
+// WriteV writes bufs, one after the other, at offset without
+// intermediate copies.
+func (img *Image) WriteV(offset uint64, bufs [][]byte) (int, error) {
+	return img.WriteVContext(context.Background(), offset, bufs)
+}
+
+// WriteVContext is WriteV passing ctx to the observer.
+func (img *Image) WriteVContext(ctx context.Context, offset uint64, bufs [][]byte) (int, error) {
+	cp, err := img.aioV(ctx, "writev", offset, bufs)
+	if err != nil {
+		return 0, err
+	}
+	return cp.Wait()
+}
@@ -0,0 +1,109 @@
+package rbd
+
+/*
+#cgo LDFLAGS: -lrados -lrbd
+#include "stdlib.h"
+#include <errno.h>
+#include <rados/librados.h>
+#include <rbd/librbd.h>
+*/
+import "C"
+import "context"
+import "fmt"
+import "time"
+import "unsafe"
+
+// WriteZeroesThickProvision is a flag of WriteZeroes allocating the zeroed
+// range instead of deallocating it.
+const WriteZeroesThickProvision = C.RBD_WRITE_ZEROES_FLAG_THICK_PROVISION
+
+// ErrMismatch is returned by CompareAndWrite when the data of the image
+// differs from the data compared.
+type ErrMismatch struct {
+	// Offset is the offset in the image of the first differing byte.
+	Offset uint64
+}
+
+func (e *ErrMismatch) Error() string {
+	return fmt.Sprintf("compare and write: data mismatch at offset %d", e.Offset)
+}
+
+// WriteSame fills length bytes at offset with copies of pattern.  length
+// must be a multiple of the length of pattern.
+func (img *Image) WriteSame(offset uint64, length uint64, pattern []byte) error {
+	return img.WriteSameContext(context.Background(), offset, length, pattern)
+}
+
+// WriteSameContext is WriteSame passing ctx to the observer.
+func (img *Image) WriteSameContext(ctx context.Context, offset uint64, length uint64, pattern []byte) (err error) {
+	defer img.observeIO(ctx, "write_same", int64(offset), int(length), time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	if len(pattern) == 0 || length%uint64(len(pattern)) != 0 {
+		return fmt.Errorf("Cannot write same to image %s: length %d is not a multiple of the pattern length %d", img.name, length, len(pattern))
+	}
+	retC := C.rbd_writesame(img.getC(), C.uint64_t(offset), C.size_t(length),
+		(*C.char)(unsafe.Pointer(&pattern[0])), C.size_t(len(pattern)), 0)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot write same to %d+%d in image %s", offset, length, img.name), 0, C.int(retC)}
+	}
+	return nil
+}
+
+// WriteZeroes zeroes length bytes at offset.  Unless flags has
+// WriteZeroesThickProvision, the zeroed range may be deallocated.
+func (img *Image) WriteZeroes(offset uint64, length uint64, flags int) error {
+	return img.WriteZeroesContext(context.Background(), offset, length, flags)
+}
+
+// WriteZeroesContext is WriteZeroes passing ctx to the observer.
+func (img *Image) WriteZeroesContext(ctx context.Context, offset uint64, length uint64, flags int) (err error) {
+	defer img.observeIO(ctx, "write_zeroes", int64(offset), int(length), time.Now(), nil, &err)
+	if err := img.lock(); err != nil {
+		return err
+	}
+	defer img.unlock()
+	retC := C.rbd_write_zeroes(img.getC(), C.uint64_t(offset), C.size_t(length), C.int(flags), 0)
+	if retC < 0 {
+		return &cError{fmt.Sprintf("Cannot write zeroes to %d+%d in image %s", offset, length, img.name), 0, C.int(retC)}
+	}
+	return nil
+}
+
+// CompareAndWrite atomically writes buf at offset if the data at offset is
+// cmp.  cmp and buf must have the same length, and librbd requires them not
+// to span more than one object.  When the data differs, nothing is written
+// and an *ErrMismatch is returned along with the offset of the first
+// differing byte.
+func (img *Image) CompareAndWrite(offset uint64, cmp []byte, buf []byte) (uint64, error) {
+	return img.CompareAndWriteContext(context.Background(), offset, cmp, buf)
+}
+
+// CompareAndWriteContext is CompareAndWrite passing ctx to the observer.
+func (img *Image) CompareAndWriteContext(ctx context.Context, offset uint64, cmp []byte, buf []byte) (mismatchOffset uint64, err error) {
+	n := 0
+	defer img.observeIO(ctx, "compare_and_write", int64(offset), len(buf), time.Now(), &n, &err)
+	if err := img.lock(); err != nil {
+		return 0, err
+	}
+	defer img.unlock()
+	if len(cmp) != len(buf) {
+		return 0, fmt.Errorf("Cannot compare and write to image %s: compared %d bytes, written %d", img.name, len(cmp), len(buf))
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	var mismatchC C.uint64_t
+	retC := C.rbd_compare_and_write(img.getC(), C.uint64_t(offset), C.size_t(len(buf)),
+		(*C.char)(unsafe.Pointer(&cmp[0])), (*C.char)(unsafe.Pointer(&buf[0])), &mismatchC, 0)
+	if retC == -C.EILSEQ {
+		return uint64(mismatchC), &ErrMismatch{uint64(mismatchC)}
+	}
+	if retC < 0 {
+		return 0, &cError{fmt.Sprintf("Cannot compare and write to %d+%d in image %s", offset, len(buf), img.name), 0, C.int(retC)}
+	}
+	n = len(buf)
+	return 0, nil
+}